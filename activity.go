@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Daily activity summaries of a cane user, built from Stats. Days run
+// midnight to midnight in the user's preferred timezone; ?tz= only changes
+// how timestamps are rendered.
+//
+// Each reading is taken to cover the time until the next one, up to
+// activityMaxGap, which is split between home (within the home place's radius
+// of Users.home_lat/home_long, or STAY_RADIUS_METERS) and outdoors. Legs
+// between readings at walking pace count towards the distance walked and the
+// active minutes; slower ones are GPS drift, faster ones are a vehicle, and
+// a lone fix far off the path is skipped. Trips are counted by running the
+// day through the stay/trip segmentation. Charge cycles are the battery
+// points gained while charging, in full charges; a rise of less than
+// chargeMinRise is jitter in the reported level. Fixes less accurate than
+// FENCE_MAX_ACCURACY_METERS are only used for heart rate and battery.
+//
+// Summaries of finished days are stored in DailySummaries. runDailySummaries
+// summarises the finished days with readings after each user's watermark in
+// ActivityWatermarks, history included on the first pass. A late reading
+// deletes the summary of its day and moves the watermark back before it.
+
+const (
+	activityMaxGap         = 10 * time.Minute
+	walkMinSpeed           = 0.3 // m/s
+	walkMaxSpeed           = 3.0 // m/s
+	chargeMinRise          = 5   // battery points
+	maxActivityDays        = 366
+	dailySummariesInterval = time.Hour
+)
+
+type DailySummary struct {
+	Date           string    `json:"date"`
+	Readings       int       `json:"readings"`
+	DistanceMeters float64   `json:"distance_meters"`
+	ActiveMinutes  int       `json:"active_minutes"`
+	HomeMinutes    int       `json:"home_minutes"`
+	OutdoorMinutes int       `json:"outdoor_minutes"`
+	Trips          int       `json:"trips"`
+	AvgHeartRate   *float64  `json:"avg_heart_rate"`
+	MaxHeartRate   *int      `json:"max_heart_rate"`
+	ChargeCycles   float64   `json:"charge_cycles"`
+	Partial        bool      `json:"partial"` // the day isn't over yet
+	ComputedAt     time.Time `json:"computed_at"`
+}
+
+type DailySummaryResponse struct {
+	UserID    string         `json:"user_id"`
+	Timezone  string         `json:"timezone"`
+	StartDate string         `json:"start_date"`
+	EndDate   string         `json:"end_date"`
+	Days      []DailySummary `json:"days"`
+}
+
+type activityPoint struct {
+	At        time.Time
+	Longitude float64
+	Latitude  float64
+	Accuracy  *float64
+	Battery   int
+	HeartRate *int
+}
+
+type homeArea struct {
+	Longitude float64
+	Latitude  float64
+	Radius    float64
+}
+
+func loadHomeArea(ctx context.Context, db dbtx, userID string) (homeArea, error) {
+	var home homeArea
+	err := db.QueryRow(ctx, `
+		SELECT u.home_long, u.home_lat, COALESCE(p.radius, $2)
+		FROM Users u
+		LEFT JOIN Places p ON p.user_id = u.user_id AND p.category = $3
+		WHERE u.user_id = $1
+	`, userID, stayRadius(), homePlaceCategory).Scan(&home.Longitude, &home.Latitude, &home.Radius)
+	return home, err
+}
+
+// summarizeActivity summarises the readings of one day, oldest first. until
+// is the end of the day, or now for today.
+func summarizeActivity(points []activityPoint, home homeArea, until time.Time) DailySummary {
+	s := DailySummary{Readings: len(points)}
+
+	var hrSum, hrCount int
+	var fixes []activityPoint
+	maxAccuracy := fenceMaxAccuracy()
+	for _, p := range points {
+		if p.HeartRate != nil {
+			hrSum += *p.HeartRate
+			hrCount++
+			if s.MaxHeartRate == nil || *p.HeartRate > *s.MaxHeartRate {
+				s.MaxHeartRate = p.HeartRate
+			}
+		}
+		if p.Accuracy == nil || *p.Accuracy <= maxAccuracy {
+			fixes = append(fixes, p)
+		}
+	}
+
+	var homeTime, outdoorTime, activeTime time.Duration
+	var seg segmentState
+	radius, minStay := stayRadius(), stayMinDuration()
+	var prev *activityPoint
+	for i := range fixes {
+		p := &fixes[i]
+
+		next := until
+		if i+1 < len(fixes) {
+			next = fixes[i+1].At
+		}
+		covered := max(min(next.Sub(p.At), activityMaxGap), 0)
+		if distanceMeters(p.Latitude, p.Longitude, home.Latitude, home.Longitude) <= home.Radius {
+			homeTime += covered
+		} else {
+			outdoorTime += covered
+		}
+
+		closed, _ := seg.advance("", segmentPoint{At: p.At, Longitude: p.Longitude, Latitude: p.Latitude}, radius, minStay)
+		if closed != nil && closed.Kind == segmentTrip {
+			s.Trips++
+		}
+
+		if activitySpike(fixes, i, radius) {
+			continue
+		}
+		if prev != nil {
+			gap := p.At.Sub(prev.At)
+			leg := distanceMeters(prev.Latitude, prev.Longitude, p.Latitude, p.Longitude)
+			if gap > 0 && gap <= activityMaxGap {
+				if speed := leg / gap.Seconds(); speed >= walkMinSpeed && speed <= walkMaxSpeed {
+					s.DistanceMeters += leg
+					activeTime += gap
+				}
+			}
+		}
+		prev = p
+	}
+	// A trip still going at the end of the day counts if it went anywhere
+	if seg.Open != nil && seg.Open.Kind == segmentTrip && seg.Open.DistanceMeters > radius {
+		s.Trips++
+	}
+
+	s.DistanceMeters = math.Round(s.DistanceMeters)
+	s.ActiveMinutes = int(math.Round(activeTime.Minutes()))
+	s.HomeMinutes = int(math.Round(homeTime.Minutes()))
+	s.OutdoorMinutes = int(math.Round(outdoorTime.Minutes()))
+	s.ChargeCycles = float64(chargedPoints(points)) / 100
+	if hrCount > 0 {
+		avg := math.Round(float64(hrSum)/float64(hrCount)*10) / 10
+		s.AvgHeartRate = &avg
+	}
+	return s
+}
+
+// activitySpike reports whether fix i is a stray: far from both neighbours,
+// which are close to each other.
+func activitySpike(fixes []activityPoint, i int, radius float64) bool {
+	if i == 0 || i+1 >= len(fixes) {
+		return false
+	}
+	before, p, after := fixes[i-1], fixes[i], fixes[i+1]
+	return distanceMeters(before.Latitude, before.Longitude, p.Latitude, p.Longitude) > radius &&
+		distanceMeters(p.Latitude, p.Longitude, after.Latitude, after.Longitude) > radius &&
+		distanceMeters(before.Latitude, before.Longitude, after.Latitude, after.Longitude) <= radius
+}
+
+// chargedPoints returns the battery points gained while charging. A charge
+// runs from the lowest level before it to the highest, and ends once the
+// level falls chargeMinRise below that; charges smaller than chargeMinRise
+// are left out, so the level wobbling by a point or two adds nothing.
+func chargedPoints(points []activityPoint) int {
+	if len(points) == 0 {
+		return 0
+	}
+	charged := 0
+	low, high := points[0].Battery, points[0].Battery
+	for _, p := range points[1:] {
+		switch {
+		case p.Battery > high:
+			high = p.Battery
+		case p.Battery <= high-chargeMinRise:
+			if high-low >= chargeMinRise {
+				charged += high - low
+			}
+			low, high = p.Battery, p.Battery
+		case p.Battery < low:
+			low, high = p.Battery, p.Battery
+		}
+	}
+	if high-low >= chargeMinRise {
+		charged += high - low
+	}
+	return charged
+}
+
+// computeDailySummary summarises the day starting at dayStart in loc. Today
+// is summarised up to now and marked partial.
+func computeDailySummary(ctx context.Context, db dbtx, userID string, home homeArea, dayStart time.Time) (DailySummary, error) {
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	now := time.Now()
+	until := dayEnd
+	if now.Before(dayEnd) {
+		until = now
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT created_at, longitude, latitude, accuracy, battery, heart_rate FROM Stats
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at
+	`, userID, dayStart, dayEnd)
+	if err != nil {
+		return DailySummary{}, err
+	}
+	points, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (activityPoint, error) {
+		var p activityPoint
+		err := row.Scan(&p.At, &p.Longitude, &p.Latitude, &p.Accuracy, &p.Battery, &p.HeartRate)
+		return p, err
+	})
+	if err != nil {
+		return DailySummary{}, err
+	}
+
+	s := summarizeActivity(points, home, until)
+	s.Date = dayStart.Format(time.DateOnly)
+	s.Partial = until.Before(dayEnd)
+	s.ComputedAt = now
+	return s, nil
+}
+
+func saveDailySummary(ctx context.Context, db dbtx, userID string, loc *time.Location, s DailySummary) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO DailySummaries (user_id, day, timezone, readings, distance_meters, active_minutes, home_minutes,
+		                            outdoor_minutes, trips, avg_heart_rate, max_heart_rate, charge_cycles, computed_at)
+		VALUES ($1, $2::date, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			timezone = EXCLUDED.timezone,
+			readings = EXCLUDED.readings,
+			distance_meters = EXCLUDED.distance_meters,
+			active_minutes = EXCLUDED.active_minutes,
+			home_minutes = EXCLUDED.home_minutes,
+			outdoor_minutes = EXCLUDED.outdoor_minutes,
+			trips = EXCLUDED.trips,
+			avg_heart_rate = EXCLUDED.avg_heart_rate,
+			max_heart_rate = EXCLUDED.max_heart_rate,
+			charge_cycles = EXCLUDED.charge_cycles,
+			computed_at = EXCLUDED.computed_at
+	`, userID, s.Date, loc.String(), s.Readings, s.DistanceMeters, s.ActiveMinutes, s.HomeMinutes,
+		s.OutdoorMinutes, s.Trips, s.AvgHeartRate, s.MaxHeartRate, s.ChargeCycles, s.ComputedAt)
+	return err
+}
+
+// invalidateDailySummary drops the stored summary of the day a late reading
+// belongs to and moves the watermark back before that day, so it is computed
+// again. It runs in the ingest transaction.
+func invalidateDailySummary(ctx context.Context, tx pgx.Tx, userID string, r StatusRequest) error {
+	// The local date is within a day of the UTC one, which keeps to the index
+	utc := r.recordedAt.UTC()
+	_, err := tx.Exec(ctx, `
+		DELETE FROM DailySummaries
+		WHERE user_id = $1 AND day BETWEEN $3::date AND $4::date
+		  AND day = (timezone(timezone, $2::timestamptz))::date
+	`, userID, r.recordedAt, utc.AddDate(0, 0, -1).Format(time.DateOnly), utc.AddDate(0, 0, 1).Format(time.DateOnly))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE ActivityWatermarks SET summarized_through = (timezone(timezone, $2::timestamptz))::date - 1
+		WHERE user_id = $1 AND summarized_through >= (timezone(timezone, $2::timestamptz))::date
+	`, userID, r.recordedAt)
+	return err
+}
+
+// GET /activity/daily?start_date=YYYY-MM-DD&end_date=YYYY-MM-DD[&user_id=]
+// end_date defaults to start_date. Days that haven't started yet are left out.
+func getDailySummaries(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	prefs, err := loadPreferences(ctx, DB, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch preferences"})
+	}
+	loc := prefs.location()
+
+	if c.QueryParam("start_date") == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "start_date is required"})
+	}
+	start, err := time.ParseInLocation(time.DateOnly, c.QueryParam("start_date"), loc)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid start_date, please use YYYY-MM-DD"})
+	}
+	end := start
+	if v := c.QueryParam("end_date"); v != "" {
+		if end, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid end_date, please use YYYY-MM-DD"})
+		}
+	}
+	if end.Before(start) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "end_date must not be before start_date"})
+	}
+	if end.After(start.AddDate(0, 0, maxActivityDays-1)) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "date range is limited to 366 days"})
+	}
+
+	stored := map[string]DailySummary{}
+	rows, err := DB.Query(ctx, `
+		SELECT to_char(day, 'YYYY-MM-DD'), readings, distance_meters, active_minutes, home_minutes, outdoor_minutes,
+		       trips, avg_heart_rate, max_heart_rate, charge_cycles, computed_at
+		FROM DailySummaries
+		WHERE user_id = $1 AND timezone = $2 AND day BETWEEN $3::date AND $4::date
+	`, userID, loc.String(), start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch daily summaries"})
+	}
+	for rows.Next() {
+		var s DailySummary
+		if err := rows.Scan(&s.Date, &s.Readings, &s.DistanceMeters, &s.ActiveMinutes, &s.HomeMinutes, &s.OutdoorMinutes,
+			&s.Trips, &s.AvgHeartRate, &s.MaxHeartRate, &s.ChargeCycles, &s.ComputedAt); err != nil {
+			rows.Close()
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to scan daily summary"})
+		}
+		stored[s.Date] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error reading rows"})
+	}
+
+	resp := DailySummaryResponse{
+		UserID:    userID,
+		Timezone:  loc.String(),
+		StartDate: start.Format(time.DateOnly),
+		EndDate:   end.Format(time.DateOnly),
+		Days:      []DailySummary{},
+	}
+	var home *homeArea
+	now := time.Now()
+	for day := start; !day.After(end) && day.Before(now); day = day.AddDate(0, 0, 1) {
+		if s, ok := stored[day.Format(time.DateOnly)]; ok {
+			resp.Days = append(resp.Days, s)
+			continue
+		}
+		if home == nil {
+			h, err := loadHomeArea(ctx, DB, userID)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch home location"})
+			}
+			home = &h
+		}
+		s, err := computeDailySummary(ctx, DB, userID, *home, day)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to summarise " + day.Format(time.DateOnly)})
+		}
+		if !s.Partial {
+			if err := saveDailySummary(ctx, DB, userID, loc, s); err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to save daily summary"})
+			}
+		}
+		resp.Days = append(resp.Days, s)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// runDailySummaries stores the summaries of finished days until the process
+// exits. The first pass backfills existing history.
+func runDailySummaries() {
+	ticker := time.NewTicker(dailySummariesInterval)
+	defer ticker.Stop()
+	for {
+		if err := summarizeFinishedDays(context.Background()); err != nil {
+			log.Printf("[activity] summarising days failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// summarizeFinishedDays stores a summary for every finished day with
+// readings after the user's watermark. A user that fails is logged and left
+// for the next pass.
+func summarizeFinishedDays(ctx context.Context) error {
+	// Every user that has sent a reading has a Connectivity row
+	rows, err := DB.Query(ctx, `SELECT user_id FROM Connectivity`)
+	if err != nil {
+		return err
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range users {
+		if err := summarizeUserDays(ctx, userID); err != nil {
+			log.Printf("[activity] summarising days for %s failed: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// summarizeUserDays summarises the finished days after the user's watermark
+// that aren't stored yet, then moves the watermark up to yesterday. The
+// watermark only counts in the timezone it was set in; after a change of
+// timezone the whole history is looked at again.
+func summarizeUserDays(ctx context.Context, userID string) error {
+	prefs, err := loadPreferences(ctx, DB, userID)
+	if err != nil {
+		return err
+	}
+	loc := prefs.location()
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	// The row exists before the scan, so a late reading during it can move
+	// the watermark back and keep it from being advanced below
+	_, err = DB.Exec(ctx, `
+		INSERT INTO ActivityWatermarks (user_id, timezone) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID, loc.String())
+	if err != nil {
+		return err
+	}
+	var timezone string
+	var through *time.Time
+	err = DB.QueryRow(ctx, `
+		SELECT timezone, summarized_through FROM ActivityWatermarks WHERE user_id = $1
+	`, userID).Scan(&timezone, &through)
+	if err != nil {
+		return err
+	}
+	var from *time.Time
+	if through != nil && timezone == loc.String() {
+		next := time.Date(through.Year(), through.Month(), through.Day()+1, 0, 0, 0, 0, loc)
+		from = &next
+	}
+
+	rows, err := DB.Query(ctx, `
+		SELECT to_char(day, 'YYYY-MM-DD') FROM (
+			SELECT DISTINCT (timezone($2, created_at))::date AS day
+			FROM Stats WHERE user_id = $1 AND created_at < $3
+			  AND ($4::timestamptz IS NULL OR created_at >= $4)
+			EXCEPT
+			SELECT day FROM DailySummaries WHERE user_id = $1 AND timezone = $2
+		) missing
+		ORDER BY 1
+	`, userID, loc.String(), today, from)
+	if err != nil {
+		return err
+	}
+	days, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	if len(days) > 0 {
+		home, err := loadHomeArea(ctx, DB, userID)
+		if err != nil {
+			return err
+		}
+		for _, d := range days {
+			dayStart, err := time.ParseInLocation(time.DateOnly, d, loc)
+			if err != nil {
+				return err
+			}
+			s, err := computeDailySummary(ctx, DB, userID, home, dayStart)
+			if err != nil {
+				return err
+			}
+			if err := saveDailySummary(ctx, DB, userID, loc, s); err != nil {
+				return err
+			}
+		}
+		log.Printf("[activity] summarised %d day(s) for %s", len(days), userID)
+	}
+
+	_, err = DB.Exec(ctx, `
+		UPDATE ActivityWatermarks SET timezone = $2, summarized_through = $3::date
+		WHERE user_id = $1 AND timezone = $4 AND summarized_through IS NOT DISTINCT FROM $5::date
+	`, userID, loc.String(), today.AddDate(0, 0, -1).Format(time.DateOnly), timezone, through)
+	return err
+}
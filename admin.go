@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Support tooling for Admin accounts, mounted under /admin. Admins do not get
+// access to user data through the regular routes; everything goes through
+// these handlers, and each one writes an AdminAudit row. Admin accounts always
+// need two-factor authentication.
+//
+// The first admin is promoted by hand:
+//
+//	UPDATE Users SET type = 'Admin' WHERE email = 'support@senseway.ca';
+
+const adminRole = "Admin"
+
+const (
+	adminSearchDefaultLimit = 50
+	adminSearchMaxLimit     = 200
+)
+
+var userRoles = map[string]bool{
+	"Cane_User": true,
+	"Caregiver": true,
+	adminRole:   true,
+}
+
+type AdminUser struct {
+	UserResponse
+	DisabledAt     *time.Time `json:"disabled_at"`
+	DisabledReason string     `json:"disabled_reason"`
+}
+
+type AdminUserDetail struct {
+	User       AdminUser         `json:"user"`
+	Caregivers []AdminUser       `json:"caregivers"`
+	CaneUsers  []AdminUser       `json:"cane_users"`
+	Devices    []Device          `json:"devices"`
+	Sessions   []SessionResponse `json:"sessions"`
+}
+
+type AdminAuditEntry struct {
+	ID           int            `json:"id"`
+	AdminUserID  *string        `json:"admin_user_id"`
+	Action       string         `json:"action"`
+	TargetUserID *string        `json:"target_user_id"`
+	Details      map[string]any `json:"details"`
+	IPAddress    string         `json:"ip_address"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+type DisableUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+type SetRoleRequest struct {
+	Type string `json:"type"`
+}
+
+type AdminGuardianRequest struct {
+	CaneUserID      string `json:"cane_user_id"`
+	CaregiverUserID string `json:"caregiver_user_id"`
+}
+
+const adminUserColumns = `user_id, email, name, type, birth_date, home_long, home_lat, avatar_url,
+	email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at, disabled_at, disabled_reason`
+
+func scanAdminUser(row pgx.Row, u *AdminUser) error {
+	return row.Scan(&u.UserID, &u.Email, &u.Name, &u.Type, &u.BirthDate, &u.HomeLong, &u.HomeLat, &u.AvatarUrl,
+		&u.EmailVerified, &u.TwoFactor, &u.CreatedAt, &u.DisabledAt, &u.DisabledReason)
+}
+
+// recordAdminAction appends to the audit trail. Mutating handlers call it
+// inside their transaction so the change and its record commit together.
+func recordAdminAction(ctx context.Context, db dbtx, c echo.Context, action, targetUserID string, details echo.Map) error {
+	if details == nil {
+		details = echo.Map{}
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO AdminAudit (admin_user_id, action, target_user_id, details, ip_address)
+		VALUES ($1, $2, $3, $4, $5)
+	`, currentUser(c).UserID, action, nilIfEmpty(targetUserID), details, c.RealIP())
+	return err
+}
+
+// requireAdmin restricts a route group to Admin accounts. It runs after
+// requireAuth, so the caller is already known.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if user := currentUser(c); user == nil || user.Type != adminRole {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Admin access required"})
+		}
+		return next(c)
+	}
+}
+
+// adminTargetID reads and checks the :user_id path parameter.
+func adminTargetID(c echo.Context) (string, bool) {
+	id := strings.ToLower(c.Param("user_id"))
+	return id, isUUID(id)
+}
+
+// GET /admin/users - Search accounts by email or name (q), role (type) and
+// whether they are disabled
+func adminSearchUsers(c echo.Context) error {
+	limit := adminSearchDefaultLimit
+	if v, err := strconv.Atoi(c.QueryParam("limit")); err == nil && v > 0 {
+		limit = min(v, adminSearchMaxLimit)
+	}
+	offset := 0
+	if v, err := strconv.Atoi(c.QueryParam("offset")); err == nil && v > 0 {
+		offset = v
+	}
+
+	sql := `SELECT ` + adminUserColumns + ` FROM Users WHERE true`
+	args := []any{}
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		args = append(args, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q)+"%")
+		sql += ` AND (email ILIKE $` + strconv.Itoa(len(args)) + ` OR name ILIKE $` + strconv.Itoa(len(args)) + `)`
+	}
+	if role := c.QueryParam("type"); role != "" {
+		if !userRoles[role] {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user type"})
+		}
+		args = append(args, role)
+		sql += ` AND type = $` + strconv.Itoa(len(args))
+	}
+	switch c.QueryParam("disabled") {
+	case "true":
+		sql += ` AND disabled_at IS NOT NULL`
+	case "false":
+		sql += ` AND disabled_at IS NULL`
+	}
+	args = append(args, limit, offset)
+	sql += ` ORDER BY created_at DESC LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+
+	ctx := c.Request().Context()
+	rows, err := DB.Query(ctx, sql, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to search users"})
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := scanAdminUser(rows, &u); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan user"})
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over users"})
+	}
+
+	err = recordAdminAction(ctx, DB, c, "search_users", "", echo.Map{
+		"q": c.QueryParam("q"), "type": c.QueryParam("type"), "disabled": c.QueryParam("disabled"), "results": len(users),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// GET /admin/users/:user_id - An account with its guardian links, devices and
+// active sessions
+func adminGetUser(c echo.Context) error {
+	userID, ok := adminTargetID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+	}
+
+	ctx := c.Request().Context()
+	var detail AdminUserDetail
+	err := scanAdminUser(DB.QueryRow(ctx, `SELECT `+adminUserColumns+` FROM Users WHERE user_id = $1`, userID), &detail.User)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load user"})
+	}
+
+	if detail.Caregivers, err = adminLinkedUsers(ctx, `SELECT caregiver_user_id FROM Guardians WHERE cane_user_id = $1`, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load guardians"})
+	}
+	if detail.CaneUsers, err = adminLinkedUsers(ctx, `SELECT cane_user_id FROM Guardians WHERE caregiver_user_id = $1`, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load guardians"})
+	}
+	if detail.Devices, err = adminDevices(ctx, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load devices"})
+	}
+	if detail.Sessions, err = adminSessions(ctx, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load sessions"})
+	}
+
+	if err := recordAdminAction(ctx, DB, c, "view_user", userID, nil); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+
+	return c.JSON(http.StatusOK, detail)
+}
+
+func adminLinkedUsers(ctx context.Context, idsSQL, userID string) ([]AdminUser, error) {
+	rows, err := DB.Query(ctx, `SELECT `+adminUserColumns+` FROM Users WHERE user_id IN (`+idsSQL+`) ORDER BY name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := scanAdminUser(rows, &u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func adminDevices(ctx context.Context, userID string) ([]Device, error) {
+	rows, err := DB.Query(ctx, `SELECT `+deviceColumns+` FROM Devices WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := scanDevice(rows, &d); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func adminSessions(ctx context.Context, userID string) ([]SessionResponse, error) {
+	rows, err := DB.Query(ctx, `
+		SELECT id, name, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM Sessions
+		WHERE user_id = $1 AND expires_at > now()
+		ORDER BY last_seen_at DESC NULLS LAST
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []SessionResponse{}
+	for rows.Next() {
+		var s SessionResponse
+		if err := rows.Scan(&s.ID, &s.Name, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DELETE /admin/users/:user_id/sessions - Sign an account out everywhere
+func adminForceLogout(c echo.Context) error {
+	userID, ok := adminTargetID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	revoked, err := signOutEverywhere(ctx, tx, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke sessions"})
+	}
+	if err := recordAdminAction(ctx, tx, c, "force_logout", userID, echo.Map{"sessions": revoked}); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Sessions revoked", "sessions": revoked})
+}
+
+// signOutEverywhere ends every session and pending 2FA login of a user.
+func signOutEverywhere(ctx context.Context, db dbtx, userID string) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM Sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM LoginChallenges WHERE user_id = $1`, userID); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// POST /admin/users/:user_id/disable - Block sign-in and device access and
+// end all sessions
+func adminDisableUser(c echo.Context) error {
+	userID, ok := adminTargetID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+	}
+	if sameUser(userID, currentUser(c).UserID) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Admins cannot disable their own account"})
+	}
+	var req DisableUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "reason is required"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var user AdminUser
+	err = scanAdminUser(tx.QueryRow(ctx, `
+		UPDATE Users SET disabled_at = COALESCE(disabled_at, now()), disabled_reason = $1
+		WHERE user_id = $2
+		RETURNING `+adminUserColumns, req.Reason, userID), &user)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to disable user"})
+	}
+	revoked, err := signOutEverywhere(ctx, tx, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke sessions"})
+	}
+	if err := recordAdminAction(ctx, tx, c, "disable_user", userID, echo.Map{"reason": req.Reason, "sessions": revoked}); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// POST /admin/users/:user_id/enable - Lift a disable
+func adminEnableUser(c echo.Context) error {
+	userID, ok := adminTargetID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var user AdminUser
+	err = scanAdminUser(tx.QueryRow(ctx, `
+		UPDATE Users SET disabled_at = NULL, disabled_reason = ''
+		WHERE user_id = $1
+		RETURNING `+adminUserColumns, userID), &user)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to enable user"})
+	}
+	if err := recordAdminAction(ctx, tx, c, "enable_user", userID, nil); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// PUT /admin/users/:user_id/role - Change an account's role, including
+// granting or removing Admin
+func adminSetRole(c echo.Context) error {
+	userID, ok := adminTargetID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+	}
+	var req SetRoleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if !userRoles[req.Type] {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user type"})
+	}
+	if sameUser(userID, currentUser(c).UserID) && req.Type != adminRole {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Admins cannot remove their own admin role"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var previous string
+	err = tx.QueryRow(ctx, `SELECT type FROM Users WHERE user_id = $1 FOR UPDATE`, userID).Scan(&previous)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	// Links only make sense for the role they were made under
+	var linked bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM Guardians WHERE caregiver_user_id = $1 OR cane_user_id = $1)
+		    OR EXISTS (SELECT 1 FROM Devices WHERE user_id = $1 AND revoked_at IS NULL)
+	`, userID).Scan(&linked)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check account links"})
+	}
+	if linked && previous != req.Type {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Remove guardian links and devices before changing account type"})
+	}
+
+	var user AdminUser
+	err = scanAdminUser(tx.QueryRow(ctx,
+		`UPDATE Users SET type = $1 WHERE user_id = $2 RETURNING `+adminUserColumns, req.Type, userID), &user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update role"})
+	}
+	if err := recordAdminAction(ctx, tx, c, "set_role", userID, echo.Map{"from": previous, "to": req.Type}); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// POST /admin/guardians - Link a caregiver to a cane user without an invite
+func adminLinkGuardian(c echo.Context) error {
+	var req AdminGuardianRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if !isUUID(req.CaneUserID) || !isUUID(req.CaregiverUserID) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "cane_user_id and caregiver_user_id must be valid user ids"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var guardian GuardianResponse
+	err = tx.QueryRow(ctx, `
+		INSERT INTO Guardians (cane_user_id, caregiver_user_id)
+		SELECT cane.user_id, caregiver.user_id
+		FROM Users cane, Users caregiver
+		WHERE cane.user_id = $1 AND cane.type = 'Cane_User'
+		  AND caregiver.user_id = $2 AND caregiver.type = 'Caregiver'
+		ON CONFLICT (cane_user_id, caregiver_user_id) DO NOTHING
+		RETURNING id, cane_user_id, caregiver_user_id, created_at
+	`, req.CaneUserID, req.CaregiverUserID).Scan(&guardian.ID, &guardian.CaneUserID, &guardian.CaregiverUserID, &guardian.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Users are already linked, or cane_user_id is not a Cane_User or caregiver_user_id not a Caregiver",
+		})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create guardian relationship"})
+	}
+	err = recordAdminAction(ctx, tx, c, "link_guardian", req.CaneUserID, echo.Map{"caregiver_user_id": req.CaregiverUserID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusCreated, guardian)
+}
+
+// DELETE /admin/guardians - Remove a caregiver's link to a cane user
+func adminUnlinkGuardian(c echo.Context) error {
+	var req AdminGuardianRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if !isUUID(req.CaneUserID) || !isUUID(req.CaregiverUserID) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "cane_user_id and caregiver_user_id must be valid user ids"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `DELETE FROM Guardians WHERE cane_user_id = $1 AND caregiver_user_id = $2`,
+		req.CaneUserID, req.CaregiverUserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete guardian relationship"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Guardian relationship not found"})
+	}
+	err = recordAdminAction(ctx, tx, c, "unlink_guardian", req.CaneUserID, echo.Map{"caregiver_user_id": req.CaregiverUserID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record audit entry"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Guardian relationship deleted"})
+}
+
+// GET /admin/audit - The audit trail, newest first, optionally narrowed to
+// a target user (user_id) or the admin who acted (admin_id)
+func adminListAudit(c echo.Context) error {
+	limit := adminSearchDefaultLimit
+	if v, err := strconv.Atoi(c.QueryParam("limit")); err == nil && v > 0 {
+		limit = min(v, adminSearchMaxLimit)
+	}
+
+	sql := `SELECT id, admin_user_id, action, target_user_id, details, ip_address, created_at FROM AdminAudit WHERE true`
+	args := []any{}
+	if id := c.QueryParam("user_id"); id != "" {
+		if !isUUID(id) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user id"})
+		}
+		args = append(args, id)
+		sql += ` AND target_user_id = $` + strconv.Itoa(len(args))
+	}
+	if id := c.QueryParam("admin_id"); id != "" {
+		if !isUUID(id) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid admin id"})
+		}
+		args = append(args, id)
+		sql += ` AND admin_user_id = $` + strconv.Itoa(len(args))
+	}
+	args = append(args, limit)
+	sql += ` ORDER BY created_at DESC, id DESC LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := DB.Query(c.Request().Context(), sql, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to retrieve audit trail"})
+	}
+	defer rows.Close()
+
+	entries := []AdminAuditEntry{}
+	for rows.Next() {
+		var e AdminAuditEntry
+		if err := rows.Scan(&e.ID, &e.AdminUserID, &e.Action, &e.TargetUserID, &e.Details, &e.IPAddress, &e.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan audit entry"})
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over audit trail"})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
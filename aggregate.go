@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Summaries of heart rate and battery per minute, hour or day, so clients
+// can chart long ranges without downloading every reading. Buckets follow
+// the wall clock of a timezone: the ?tz= of the request if given, otherwise
+// the user's preferred timezone, so a day bucket runs midnight to midnight
+// where the user lives, DST changes included. Buckets without readings are
+// left out.
+
+const maxAggregateBuckets = 10000
+
+var aggregateBuckets = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+type StatBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Min   int       `json:"min"`
+	Max   int       `json:"max"`
+	Avg   float64   `json:"avg"`
+	P10   float64   `json:"p10"`
+	P50   float64   `json:"p50"`
+	P90   float64   `json:"p90"`
+}
+
+type StatAggregateResponse struct {
+	UserID    string       `json:"user_id"`
+	Metric    string       `json:"metric"`
+	Bucket    string       `json:"bucket"`
+	Timezone  string       `json:"timezone"`
+	StartTime time.Time    `json:"start_time"`
+	EndTime   time.Time    `json:"end_time"`
+	Buckets   []StatBucket `json:"buckets"`
+}
+
+// GET /heartRate/aggregate?start_time=&end_time=&bucket=minute|hour|day[&user_id=]
+func getHeartRateAggregate(c echo.Context) error {
+	return aggregateStats(c, "heart_rate")
+}
+
+// GET /battery/aggregate?start_time=&end_time=&bucket=minute|hour|day[&user_id=]
+func getBatteryAggregate(c echo.Context) error {
+	return aggregateStats(c, "battery")
+}
+
+// aggregateStats summarises one Stats column; metric is always a constant
+// from the handlers above, never user input.
+func aggregateStats(c echo.Context, metric string) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	bucket := c.QueryParam("bucket")
+	if bucket == "" {
+		bucket = "hour"
+	}
+	width, ok := aggregateBuckets[bucket]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "bucket must be minute, hour or day"})
+	}
+
+	if c.QueryParam("start_time") == "" || c.QueryParam("end_time") == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "start_time and end_time are required"})
+	}
+	start, err := time.Parse(iso8601Format, c.QueryParam("start_time"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid start_time format, please use ISO 8601 format (e.g., 2025-11-14T00:00:00Z)",
+		})
+	}
+	end, err := time.Parse(iso8601Format, c.QueryParam("end_time"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid end_time format, please use ISO 8601 format (e.g., 2025-11-14T23:59:59Z)",
+		})
+	}
+	if !end.After(start) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "end_time must be after start_time"})
+	}
+	if end.Sub(start)/width > maxAggregateBuckets {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "time range has too many buckets; use a larger bucket"})
+	}
+
+	ctx := c.Request().Context()
+	loc := responseLocation(c)
+	if loc == nil {
+		prefs, err := loadPreferences(ctx, DB, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch preferences"})
+		}
+		loc = prefs.location()
+	}
+
+	query := `
+		SELECT date_trunc($4, created_at, $5) AS bucket,
+		       count(*),
+		       min(` + metric + `), max(` + metric + `), avg(` + metric + `),
+		       percentile_cont(ARRAY[0.1, 0.5, 0.9]) WITHIN GROUP (ORDER BY ` + metric + `)
+		FROM stats
+		WHERE user_id = $1
+		  AND created_at >= $2
+		  AND created_at < $3
+		  AND ` + metric + ` IS NOT NULL
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+	rows, err := DB.Query(ctx, query, userID, start, end, bucket, loc.String())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to aggregate " + metric})
+	}
+	defer rows.Close()
+
+	resp := StatAggregateResponse{
+		UserID:    userID,
+		Metric:    metric,
+		Bucket:    bucket,
+		Timezone:  loc.String(),
+		StartTime: start,
+		EndTime:   end,
+		Buckets:   []StatBucket{},
+	}
+	for rows.Next() {
+		var b StatBucket
+		var percentiles []float64
+		if err := rows.Scan(&b.Start, &b.Count, &b.Min, &b.Max, &b.Avg, &percentiles); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to scan " + metric + " bucket"})
+		}
+		b.Avg = math.Round(b.Avg*10) / 10
+		b.P10, b.P50, b.P90 = percentiles[0], percentiles[1], percentiles[2]
+		resp.Buckets = append(resp.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error reading rows"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -18,6 +18,7 @@ type Appointment struct {
 	StartAt     time.Time  `json:"start_at"`
 	EndAt       *time.Time `json:"end_at"`
 	FenceID     *int       `json:"fence_id"`
+	PlaceID     *int       `json:"place_id"`
 	CreatedAt   time.Time  `json:"created_at"`
 }
 
@@ -29,6 +30,7 @@ type CreateAppointmentRequest struct {
 	StartAt     time.Time  `json:"start_at"`
 	EndAt       *time.Time `json:"end_at"`
 	FenceID     *int       `json:"fence_id"`
+	PlaceID     *int       `json:"place_id"`
 }
 
 type UpdateAppointmentRequest struct {
@@ -40,6 +42,7 @@ type UpdateAppointmentRequest struct {
 	StartAt     *time.Time `json:"start_at"`
 	EndAt       *time.Time `json:"end_at"`
 	FenceID     *int       `json:"fence_id"`
+	PlaceID     *int       `json:"place_id"`
 }
 
 func createAppointment(c echo.Context) error {
@@ -47,11 +50,12 @@ func createAppointment(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
-	req.UserID = strings.TrimSpace(req.UserID)
-	req.Title = strings.TrimSpace(req.Title)
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id is required"})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
+	req.UserID = userID
+	req.Title = strings.TrimSpace(req.Title)
 	if req.Title == "" {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "title is required"})
 	}
@@ -60,18 +64,29 @@ func createAppointment(c echo.Context) error {
 	}
 
 	ctx := c.Request().Context()
+	if req.PlaceID != nil {
+		place, err := loadPlace(ctx, userID, *req.PlaceID)
+		if err == errPlaceNotFound {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+		}
+		if strings.TrimSpace(req.Location) == "" {
+			req.Location = placeLocation(place)
+		}
+	}
 	sql := `
-		INSERT INTO Appointments (user_id, title, location, description, start_at, end_at, fence_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, user_id, title, location, description, start_at, end_at, fence_id, created_at
+		INSERT INTO Appointments (user_id, title, location, description, start_at, end_at, fence_id, place_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, user_id, title, location, description, start_at, end_at, fence_id, place_id, created_at
 	`
 	var appt Appointment
-	err := DB.QueryRow(ctx, sql,
+	err = DB.QueryRow(ctx, sql,
 		req.UserID, req.Title, req.Location, req.Description,
-		req.StartAt, req.EndAt, req.FenceID,
+		req.StartAt, req.EndAt, req.FenceID, req.PlaceID,
 	).Scan(
 		&appt.ID, &appt.UserID, &appt.Title, &appt.Location, &appt.Description,
-		&appt.StartAt, &appt.EndAt, &appt.FenceID, &appt.CreatedAt,
+		&appt.StartAt, &appt.EndAt, &appt.FenceID, &appt.PlaceID, &appt.CreatedAt,
 	)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to create appointment"})
@@ -80,13 +95,13 @@ func createAppointment(c echo.Context) error {
 }
 
 func listAppointments(c echo.Context) error {
-	userID := strings.TrimSpace(c.QueryParam("user_id"))
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id is required"})
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
 	}
 	ctx := c.Request().Context()
 	sql := `
-		SELECT id, user_id, title, location, description, start_at, end_at, fence_id, created_at
+		SELECT id, user_id, title, location, description, start_at, end_at, fence_id, place_id, created_at
 		FROM Appointments
 		WHERE user_id = $1
 		ORDER BY start_at ASC
@@ -101,7 +116,7 @@ func listAppointments(c echo.Context) error {
 	for rows.Next() {
 		var a Appointment
 		if err := rows.Scan(&a.ID, &a.UserID, &a.Title, &a.Location, &a.Description,
-			&a.StartAt, &a.EndAt, &a.FenceID, &a.CreatedAt); err != nil {
+			&a.StartAt, &a.EndAt, &a.FenceID, &a.PlaceID, &a.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to parse appointment"})
 		}
 		appts = append(appts, a)
@@ -117,21 +132,22 @@ func updateAppointment(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
-	req.UserID = strings.TrimSpace(req.UserID)
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id is required"})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
+	req.UserID = userID
 	if req.ID <= 0 {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid id is required"})
 	}
 
 	ctx := c.Request().Context()
 	var current Appointment
-	err := DB.QueryRow(ctx,
-		`SELECT id, user_id, title, location, description, start_at, end_at, fence_id, created_at FROM Appointments WHERE user_id = $1 AND id = $2`,
+	err = DB.QueryRow(ctx,
+		`SELECT id, user_id, title, location, description, start_at, end_at, fence_id, place_id, created_at FROM Appointments WHERE user_id = $1 AND id = $2`,
 		req.UserID, req.ID,
 	).Scan(&current.ID, &current.UserID, &current.Title, &current.Location, &current.Description,
-		&current.StartAt, &current.EndAt, &current.FenceID, &current.CreatedAt)
+		&current.StartAt, &current.EndAt, &current.FenceID, &current.PlaceID, &current.CreatedAt)
 	if err == pgx.ErrNoRows {
 		return c.JSON(http.StatusNotFound, echo.Map{"error": "appointment not found"})
 	} else if err != nil {
@@ -152,15 +168,27 @@ func updateAppointment(c echo.Context) error {
 	}
 	current.EndAt = req.EndAt
 	current.FenceID = req.FenceID
+	if req.PlaceID != nil && (current.PlaceID == nil || *current.PlaceID != *req.PlaceID) {
+		place, err := loadPlace(ctx, req.UserID, *req.PlaceID)
+		if err == errPlaceNotFound {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+		}
+		if req.Location == nil {
+			current.Location = placeLocation(place)
+		}
+	}
+	current.PlaceID = req.PlaceID
 
 	err = DB.QueryRow(ctx,
-		`UPDATE Appointments SET title=$1, location=$2, description=$3, start_at=$4, end_at=$5, fence_id=$6
-		 WHERE user_id=$7 AND id=$8
-		 RETURNING id, user_id, title, location, description, start_at, end_at, fence_id, created_at`,
-		current.Title, current.Location, current.Description, current.StartAt, current.EndAt, current.FenceID,
+		`UPDATE Appointments SET title=$1, location=$2, description=$3, start_at=$4, end_at=$5, fence_id=$6, place_id=$7
+		 WHERE user_id=$8 AND id=$9
+		 RETURNING id, user_id, title, location, description, start_at, end_at, fence_id, place_id, created_at`,
+		current.Title, current.Location, current.Description, current.StartAt, current.EndAt, current.FenceID, current.PlaceID,
 		req.UserID, req.ID,
 	).Scan(&current.ID, &current.UserID, &current.Title, &current.Location, &current.Description,
-		&current.StartAt, &current.EndAt, &current.FenceID, &current.CreatedAt)
+		&current.StartAt, &current.EndAt, &current.FenceID, &current.PlaceID, &current.CreatedAt)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update appointment"})
 	}
@@ -175,10 +203,11 @@ func deleteAppointment(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
-	req.UserID = strings.TrimSpace(req.UserID)
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id is required"})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
+	req.UserID = userID
 	if req.ID <= 0 {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid id is required"})
 	}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -15,16 +17,18 @@ import (
 )
 
 type User struct {
-	UserID       string    `json:"user_id"`
-	Email        string    `json:"email"`
-	Name         string    `json:"name"`
-	Type         string    `json:"type"`
-	BirthDate    time.Time `json:"birth_date"`
-	HomeLong     float64   `json:"home_long"`
-	HomeLat      float64   `json:"home_lat"`
-	AvatarUrl    string    `json:"avatar_url"`
-	CreatedAt    time.Time `json:"created_at"`
-	PasswordHash string    `json:"-"`
+	UserID        string    `json:"user_id"`
+	Email         string    `json:"email"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	BirthDate     time.Time `json:"birth_date"`
+	HomeLong      float64   `json:"home_long"`
+	HomeLat       float64   `json:"home_lat"`
+	AvatarUrl     string    `json:"avatar_url"`
+	EmailVerified bool      `json:"email_verified"`
+	TwoFactor     bool      `json:"two_factor_enabled"`
+	CreatedAt     time.Time `json:"created_at"`
+	PasswordHash  string    `json:"-"`
 }
 
 type RegisterRequest struct {
@@ -38,20 +42,23 @@ type RegisterRequest struct {
 }
 
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	SessionName string `json:"session_name"`
 }
 
 type UserResponse struct {
-	UserID    string    `json:"user_id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Type      string    `json:"type"`
-	BirthDate time.Time `json:"birth_date"`
-	HomeLong  float64   `json:"home_long"`
-	HomeLat   float64   `json:"home_lat"`
-	AvatarUrl string    `json:"avatar_url"`
-	CreatedAt time.Time `json:"created_at"`
+	UserID        string    `json:"user_id"`
+	Email         string    `json:"email"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	BirthDate     time.Time `json:"birth_date"`
+	HomeLong      float64   `json:"home_long"`
+	HomeLat       float64   `json:"home_lat"`
+	AvatarUrl     string    `json:"avatar_url"`
+	EmailVerified bool      `json:"email_verified"`
+	TwoFactor     bool      `json:"two_factor_enabled"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 const sessionCookieName = "pathpal_session"
@@ -78,13 +85,13 @@ func registerUser(c echo.Context) error {
 	sql := `
 		INSERT INTO Users (email, password_hash, name, type, birth_date, home_long, home_lat)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, created_at
+		RETURNING user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at
 	`
 	var user UserResponse
 	err = DB.QueryRow(context.Background(), sql,
 		req.Email, string(hashedPassword), req.Name, req.Type, req.BirthDate, req.HomeLong, req.HomeLat,
 	).Scan(
-		&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.CreatedAt,
+		&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.EmailVerified, &user.TwoFactor, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -95,6 +102,15 @@ func registerUser(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": fmt.Sprintf("Failed to create user: %v", err)})
 	}
 
+	if err := syncHomePlace(context.Background(), user.UserID, user.HomeLong, user.HomeLat); err != nil {
+		log.Printf("[auth] creating home place for %s failed: %v", user.UserID, err)
+	}
+
+	// The account exists either way; the user can ask for another link
+	if err := sendVerificationEmail(context.Background(), user.UserID, user.Name, user.Email); err != nil {
+		log.Printf("[auth] verification email for %s failed: %v", user.UserID, err)
+	}
+
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -104,13 +120,25 @@ func loginUser(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
 	}
 
-	sql := `SELECT user_id, email, password_hash, name, type, birth_date, home_long, home_lat, avatar_url, created_at FROM Users WHERE email = $1`
+	status, body, err := loginBlock(c, req.Email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	sql := `SELECT user_id, email, password_hash, name, type, birth_date, home_long, home_lat, avatar_url, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at, disabled_at IS NOT NULL FROM Users WHERE email = $1`
 	var user User
-	err := DB.QueryRow(context.Background(), sql, req.Email).Scan(
-		&user.UserID, &user.Email, &user.PasswordHash, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.CreatedAt,
+	var disabled bool
+	err = DB.QueryRow(context.Background(), sql, req.Email).Scan(
+		&user.UserID, &user.Email, &user.PasswordHash, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.EmailVerified, &user.TwoFactor, &user.CreatedAt, &disabled,
 	)
 
 	if err == pgx.ErrNoRows {
+		if err := loginFailed(c, req.Email); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
 		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid credentials"})
 	} else if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
@@ -118,124 +146,97 @@ func loginUser(c echo.Context) error {
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
 	if err != nil {
+		if err := loginFailed(c, req.Email); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
 		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid credentials"})
 	}
 
-	sessionToken, err := generateSecureToken(32)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate session token"})
+	if disabled {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Account disabled"})
 	}
 
-	tokenHash, err := bcrypt.GenerateFromPassword([]byte(sessionToken), bcrypt.DefaultCost)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to hash token"})
+	if !user.EmailVerified && emailVerificationPolicy() == verificationPolicyRequired {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Email address not verified"})
 	}
 
-	expiresAt := time.Now().Add(sessionDuration)
+	// With 2FA on, the session is only issued by POST /login/2fa, and failed
+	// attempts keep counting until then
+	if user.TwoFactor {
+		challenge, err := startLoginChallenge(context.Background(), user.UserID, req.SessionName)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to start two-factor login"})
+		}
+		return c.JSON(http.StatusOK, echo.Map{
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+		})
+	}
 
-	sql = `INSERT INTO Sessions (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`
-	_, err = DB.Exec(context.Background(), sql, user.UserID, string(tokenHash), expiresAt)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create session"})
+	if err := clearLoginThrottle(context.Background(), emailThrottleKey(user.Email)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
 	}
 
-	setSessionCookie(c, sessionToken, expiresAt)
+	if err := startSession(c, user.UserID, req.SessionName); err == errAccountDisabled {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Account disabled"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create session"})
+	}
 
 	return c.JSON(http.StatusOK, UserResponse{
-		UserID:    user.UserID,
-		Email:     user.Email,
-		Name:      user.Name,
-		Type:      user.Type,
-		BirthDate: user.BirthDate,
-		HomeLong:  user.HomeLong,
-		HomeLat:   user.HomeLat,
-		AvatarUrl: user.AvatarUrl,
-		CreatedAt: user.CreatedAt,
+		UserID:        user.UserID,
+		Email:         user.Email,
+		Name:          user.Name,
+		Type:          user.Type,
+		BirthDate:     user.BirthDate,
+		HomeLong:      user.HomeLong,
+		HomeLat:       user.HomeLat,
+		AvatarUrl:     user.AvatarUrl,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.TwoFactor,
+		CreatedAt:     user.CreatedAt,
 	})
 }
 
 func getSession(c echo.Context) error {
-	cookie, err := c.Cookie(sessionCookieName)
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "No session cookie"})
-	}
-	sessionToken := cookie.Value
-
-	sql := `SELECT user_id, token_hash FROM Sessions WHERE expires_at > $1`
-	rows, err := DB.Query(context.Background(), sql, time.Now())
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
-	}
-	defer rows.Close()
-
-	var userID string
-	var tokenHash string
-	var found = false
-
-	for rows.Next() {
-		if err := rows.Scan(&userID, &tokenHash); err != nil {
-			continue
-		}
-		if err := bcrypt.CompareHashAndPassword([]byte(tokenHash), []byte(sessionToken)); err == nil {
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid session"})
-	}
-
-	sql = `SELECT user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, created_at FROM Users WHERE user_id = $1`
-	var user UserResponse
-	err = DB.QueryRow(context.Background(), sql, userID).Scan(
-		&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.CreatedAt,
-	)
-	if err != nil {
-		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
-	}
-
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, currentUser(c))
 }
 
 func logoutUser(c echo.Context) error {
-	cookie, err := c.Cookie(sessionCookieName)
+	_, err := DB.Exec(context.Background(), "DELETE FROM Sessions WHERE id = $1", currentSessionID(c))
 	if err != nil {
-		return c.JSON(http.StatusOK, echo.Map{"message": "Not logged in"})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete session"})
 	}
-	sessionToken := cookie.Value
 
-	sql := `SELECT id, token_hash FROM Sessions WHERE expires_at > $1`
-	rows, err := DB.Query(context.Background(), sql, time.Now())
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
-	}
-	defer rows.Close()
+	clearSessionCookie(c)
 
-	var sessionID int
-	var tokenHash string
-	var found = false
+	return c.JSON(http.StatusOK, echo.Map{"message": "Logged out successfully"})
+}
 
-	for rows.Next() {
-		if err := rows.Scan(&sessionID, &tokenHash); err != nil {
-			continue
-		}
-		if err := bcrypt.CompareHashAndPassword([]byte(tokenHash), []byte(sessionToken)); err == nil {
-			found = true
-			break
-		}
-	}
+var errInvalidSession = errors.New("invalid session")
 
-	if found {
-		_, err := DB.Exec(context.Background(), "DELETE FROM Sessions WHERE id = $1", sessionID)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete session"})
-		}
+// findSession returns the id and owner of the live session matching token.
+// Tokens are looked up by their keyed hash.
+func findSession(ctx context.Context, token string) (int, string, error) {
+	sql := `SELECT id, user_id FROM Sessions WHERE token_hash = $1 AND expires_at > $2`
+	var sessionID int
+	var userID string
+	err := DB.QueryRow(ctx, sql, hashToken(token), time.Now()).Scan(&sessionID, &userID)
+	if err == pgx.ErrNoRows {
+		return 0, "", errInvalidSession
+	} else if err != nil {
+		return 0, "", err
 	}
+	return sessionID, userID, nil
+}
 
-	clearSessionCookie(c)
-
-	return c.JSON(http.StatusOK, echo.Map{"message": "Logged out successfully"})
+func loadUser(ctx context.Context, userID string) (UserResponse, error) {
+	sql := `SELECT user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at FROM Users WHERE user_id = $1`
+	var user UserResponse
+	err := DB.QueryRow(ctx, sql, userID).Scan(
+		&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate, &user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.EmailVerified, &user.TwoFactor, &user.CreatedAt,
+	)
+	return user, err
 }
 
 func setSessionCookie(c echo.Context, token string, expires time.Time) {
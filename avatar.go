@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Uploaded avatars are decoded, turned upright, centre-cropped to a square and
+// re-encoded as JPEG at each of avatarSizes. Re-encoding drops all metadata,
+// including EXIF location data. Files are stored as <avatar_key>-<size>.jpg
+// and avatar_url points at the avatarDefaultSize copy.
+
+var avatarSizes = []int{64, 128, 256, 512}
+
+const (
+	avatarDefaultSize = 256
+	avatarMinSide     = 32
+	avatarMaxPixels   = 24_000_000 // decoded size guard against decompression bombs
+	avatarJPEGQuality = 85
+)
+
+var errInvalidImage = errors.New("file must be a JPEG, PNG or GIF image")
+
+type AvatarResponse struct {
+	AvatarUrl  string            `json:"avatar_url"`
+	AvatarUrls map[string]string `json:"avatar_urls"`
+}
+
+// avatarMaxBytes is the largest accepted upload, set with AVATAR_MAX_BYTES.
+func avatarMaxBytes() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("AVATAR_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return 10 << 20
+}
+
+func avatarFileKey(key string, size int) string {
+	return fmt.Sprintf("%s-%d.jpg", key, size)
+}
+
+func avatarURLs(key string) map[string]string {
+	urls := make(map[string]string, len(avatarSizes))
+	for _, size := range avatarSizes {
+		urls[strconv.Itoa(size)] = storage.URL(avatarFileKey(key, size))
+	}
+	return urls
+}
+
+// deleteAvatarFiles removes every stored size of an avatar. Failures are only
+// logged; an orphaned file is harmless.
+func deleteAvatarFiles(ctx context.Context, key string) {
+	for _, size := range avatarSizes {
+		if err := storage.Delete(ctx, avatarFileKey(key, size)); err != nil {
+			log.Printf("[avatar] deleting %s failed: %v", avatarFileKey(key, size), err)
+		}
+	}
+}
+
+// POST /user/avatar - Upload a new profile picture as the multipart field "avatar"
+func uploadAvatar(c echo.Context) error {
+	maxBytes := avatarMaxBytes()
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxBytes+64<<10)
+
+	if err := c.Request().ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{"error": "Image is too large"})
+		}
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Expected a multipart form upload"})
+	}
+
+	userID, err := selfUserID(c, c.FormValue("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "avatar file is required"})
+	}
+	if fileHeader.Size > maxBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{"error": "Image is too large"})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Failed to read upload"})
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	file.Close()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Failed to read upload"})
+	}
+	if int64(len(data)) > maxBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{"error": "Image is too large"})
+	}
+
+	images, err := processAvatar(data)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	// A fresh key per upload lets clients and CDNs cache each file forever
+	suffix, err := generateSecureToken(8)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to store avatar"})
+	}
+	key := fmt.Sprintf("avatars/%s/%s", userID, suffix)
+
+	ctx := c.Request().Context()
+	for _, size := range avatarSizes {
+		if err := storage.Put(ctx, avatarFileKey(key, size), "image/jpeg", images[size]); err != nil {
+			log.Printf("[avatar] storing %s failed: %v", avatarFileKey(key, size), err)
+			deleteAvatarFiles(context.Background(), key)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to store avatar"})
+		}
+	}
+
+	var oldKey *string
+	err = DB.QueryRow(ctx, `SELECT avatar_key FROM Users WHERE user_id = $1`, userID).Scan(&oldKey)
+	if err == nil {
+		_, err = DB.Exec(ctx,
+			`UPDATE Users SET avatar_url = $1, avatar_key = $2 WHERE user_id = $3`,
+			storage.URL(avatarFileKey(key, avatarDefaultSize)), key, userID,
+		)
+	}
+	if err != nil {
+		deleteAvatarFiles(context.Background(), key)
+		if err == pgx.ErrNoRows {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update avatar"})
+	}
+	if oldKey != nil {
+		deleteAvatarFiles(ctx, *oldKey)
+	}
+
+	return c.JSON(http.StatusOK, AvatarResponse{
+		AvatarUrl:  storage.URL(avatarFileKey(key, avatarDefaultSize)),
+		AvatarUrls: avatarURLs(key),
+	})
+}
+
+// DELETE /user/avatar - Remove the profile picture
+func deleteAvatar(c echo.Context) error {
+	userID, err := selfUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	var oldKey *string
+	err = DB.QueryRow(ctx, `
+		UPDATE Users u SET avatar_url = '', avatar_key = NULL
+		FROM Users old
+		WHERE u.user_id = $1 AND old.user_id = u.user_id
+		RETURNING old.avatar_key
+	`, userID).Scan(&oldKey)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete avatar"})
+	}
+	if oldKey != nil {
+		deleteAvatarFiles(ctx, *oldKey)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Avatar deleted"})
+}
+
+// processAvatar validates an uploaded image and returns it as a square JPEG at
+// each of avatarSizes.
+func processAvatar(data []byte) (map[int][]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	if config.Width < avatarMinSide || config.Height < avatarMinSide {
+		return nil, fmt.Errorf("image must be at least %dx%d pixels", avatarMinSide, avatarMinSide)
+	}
+	if config.Width*config.Height > avatarMaxPixels {
+		return nil, errors.New("image dimensions are too large")
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+
+	// Flatten onto white, since JPEG has no transparency
+	b := src.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+
+	if format == "jpeg" {
+		flat = applyOrientation(flat, jpegOrientation(data))
+	}
+
+	side := min(flat.Rect.Dx(), flat.Rect.Dy())
+	x0 := (flat.Rect.Dx() - side) / 2
+	y0 := (flat.Rect.Dy() - side) / 2
+	square := flat.SubImage(image.Rect(x0, y0, x0+side, y0+side)).(*image.RGBA)
+
+	out := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeBox(square, size), &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			return nil, err
+		}
+		out[size] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// resizeBox scales a square image to size×size by averaging the source pixels
+// covered by each destination pixel.
+func resizeBox(src *image.RGBA, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	sb := src.Rect
+	sw, sh := sb.Dx(), sb.Dy()
+
+	for dy := 0; dy < size; dy++ {
+		sy0 := dy * sh / size
+		sy1 := max((dy+1)*sh/size, sy0+1)
+		for dx := 0; dx < size; dx++ {
+			sx0 := dx * sw / size
+			sx1 := max((dx+1)*sw/size, sx0+1)
+
+			var r, g, bl, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sb.Min.X+sx0, sb.Min.Y+sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					bl += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(dx, dy)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(bl / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it
+// has none. Only the tag in IFD0 of the first APP1 Exif segment is read.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xD8 || marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 || marker == 0xFF {
+			i += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // image data starts; no metadata after this
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[off:]) == 0x0112 { // Orientation, a SHORT
+			if v := int(order.Uint16(tiff[off+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation returns src turned so it displays upright for the given
+// EXIF orientation.
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
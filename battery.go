@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Low_Battery events are raised as the charge falls through the user's
+// battery_thresholds preference (20%, 10% and 5% unless changed). Each
+// threshold fires once per discharge: BatteryStates keeps the lowest one
+// already reported, and charging a few points above a threshold re-arms it.
+// A reading that skips past several thresholds at once raises one event, for
+// the lowest.
+//
+// Events carry an estimate of the time left, from the drain rate over the
+// current discharge in the last few hours.
+
+const (
+	batteryRearmMargin = 3 // points above a threshold before it can fire again
+	batteryDrainWindow = 3 * time.Hour
+	batteryDrainMinAge = 10 * time.Minute // shortest span a drain rate is estimated from
+)
+
+// batteryAlertThreshold returns the threshold a reading at level should
+// report, if any, and the lowest threshold reported once it is handled.
+// alerted is the lowest threshold already reported this discharge.
+func batteryAlertThreshold(thresholds []int, alerted *int, level int) (fire *int, next *int) {
+	// Charging back above a reported threshold re-arms it
+	if alerted != nil {
+		var still *int
+		for _, t := range thresholds {
+			if t >= *alerted && level <= t+batteryRearmMargin && (still == nil || t < *still) {
+				still = &t
+			}
+		}
+		alerted = still
+	}
+
+	for _, t := range thresholds {
+		if level <= t && (alerted == nil || t < *alerted) && (fire == nil || t < *fire) {
+			fire = &t
+		}
+	}
+	if fire != nil {
+		return fire, fire
+	}
+	return nil, alerted
+}
+
+// batteryDrainPerHour estimates how fast the battery is falling, in points
+// per hour, from the readings since it last charged. ok is false without
+// enough of a discharge to go on.
+func batteryDrainPerHour(ctx context.Context, tx pgx.Tx, userID string, at time.Time) (float64, bool, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT battery, created_at FROM Stats
+		WHERE user_id = $1 AND created_at > $2 AND created_at <= $3
+		ORDER BY created_at DESC
+	`, userID, at.Add(-batteryDrainWindow), at)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	// Walk back from the newest reading until the battery was lower, which
+	// means it was charging then
+	var levels []float64
+	var hours []float64
+	prev := -1
+	for rows.Next() {
+		var level int
+		var recorded time.Time
+		if err := rows.Scan(&level, &recorded); err != nil {
+			return 0, false, err
+		}
+		if prev >= 0 && level < prev {
+			break
+		}
+		prev = level
+		levels = append(levels, float64(level))
+		hours = append(hours, recorded.Sub(at).Hours())
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	if len(levels) < 2 || -hours[len(hours)-1] < batteryDrainMinAge.Hours() {
+		return 0, false, nil
+	}
+
+	// Least squares, as readings are whole percentages
+	var meanH, meanL float64
+	for i := range levels {
+		meanH += hours[i]
+		meanL += levels[i]
+	}
+	meanH /= float64(len(levels))
+	meanL /= float64(len(levels))
+	var cov, variance float64
+	for i := range levels {
+		cov += (hours[i] - meanH) * (levels[i] - meanL)
+		variance += (hours[i] - meanH) * (hours[i] - meanH)
+	}
+	if variance == 0 || cov >= 0 {
+		return 0, false, nil
+	}
+	return -cov / variance, true, nil
+}
+
+// checkBattery raises a Low_Battery event when a new reading crosses one of
+// the user's thresholds.
+func checkBattery(ctx context.Context, tx pgx.Tx, userID string, deviceID *int, statID int, r StatusRequest) error {
+	var alerted *int
+	var lastRecordedAt *time.Time
+	err := tx.QueryRow(ctx, `
+		SELECT alerted_threshold, last_recorded_at FROM BatteryStates WHERE user_id = $1 FOR UPDATE
+	`, userID).Scan(&alerted, &lastRecordedAt)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	// A late reading from a backlog doesn't describe the battery now
+	if lastRecordedAt != nil && !r.recordedAt.After(*lastRecordedAt) {
+		return nil
+	}
+
+	prefs, err := loadPreferences(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	fire, next := batteryAlertThreshold(prefs.BatteryThresholds, alerted, r.Battery)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO BatteryStates (user_id, alerted_threshold, last_battery, last_recorded_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			alerted_threshold = EXCLUDED.alerted_threshold,
+			last_battery = EXCLUDED.last_battery,
+			last_recorded_at = EXCLUDED.last_recorded_at
+	`, userID, next, r.Battery, r.recordedAt)
+	if err != nil || fire == nil {
+		return err
+	}
+
+	details := map[string]any{
+		"stat_id":   statID,
+		"battery":   r.Battery,
+		"threshold": *fire,
+	}
+	description := fmt.Sprintf("Battery at %d%%", r.Battery)
+
+	drain, ok, err := batteryDrainPerHour(ctx, tx, userID, r.recordedAt)
+	if err != nil {
+		return err
+	}
+	if ok {
+		minutes := int(math.Round(float64(r.Battery) / drain * 60))
+		details["drain_per_hour"] = math.Round(drain*10) / 10
+		details["estimated_minutes_remaining"] = minutes
+		description += ", about " + formatMinutes(minutes) + " remaining"
+	}
+
+	_, err = insertEvent(ctx, tx, Event{
+		UserID:      userID,
+		Type:        "Low_Battery",
+		Name:        fmt.Sprintf("Battery below %d%%", *fire),
+		Description: description,
+		DeviceID:    deviceID,
+		CreatedAt:   r.recordedAt,
+		Details:     details,
+	})
+	return err
+}
+
+// formatMinutes renders a duration such as "2 h 5 min" or "40 min".
+func formatMinutes(minutes int) string {
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	if minutes%60 == 0 {
+		return fmt.Sprintf("%d h", minutes/60)
+	}
+	return fmt.Sprintf("%d h %d min", minutes/60, minutes%60)
+}
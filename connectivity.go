@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Connectivity tracks when each user's cane was last heard from. Every
+// uploaded reading marks the user online; runWatchdog marks users offline
+// once nothing has arrived for DEVICE_OFFLINE_MINUTES and writes a
+// Device_Offline event, and the next reading writes Device_Online. Times are
+// when readings were received, not recorded, since a backlog uploaded late
+// still means the cane is reachable now.
+//
+// Env vars:
+//   DEVICE_OFFLINE_MINUTES     — silence before a cane counts as offline (default 15)
+//   WATCHDOG_INTERVAL_SECONDS  — how often the watchdog looks (default 60)
+
+type Connectivity struct {
+	Online         bool      `json:"online"`
+	LastSeenAt     time.Time `json:"last_seen_at"`
+	Since          time.Time `json:"since"` // when online last changed
+	OfflineMinutes int       `json:"offline_after_minutes"`
+}
+
+func deviceOfflineAfter() time.Duration {
+	if v := os.Getenv("DEVICE_OFFLINE_MINUTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Minute
+		}
+	}
+	return 15 * time.Minute
+}
+
+func watchdogInterval() time.Duration {
+	if v := os.Getenv("WATCHDOG_INTERVAL_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return time.Minute
+}
+
+// loadConnectivity returns the user's connectivity, or nil if no reading has
+// ever arrived.
+func loadConnectivity(ctx context.Context, userID string) (*Connectivity, error) {
+	conn := Connectivity{OfflineMinutes: int(deviceOfflineAfter().Minutes())}
+	err := DB.QueryRow(ctx, `
+		SELECT online, last_seen_at, changed_at FROM Connectivity WHERE user_id = $1
+	`, userID).Scan(&conn.Online, &conn.LastSeenAt, &conn.Since)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &conn, nil
+}
+
+// markOnline records that a reading just arrived, and writes Device_Online
+// if the user had been marked offline.
+func markOnline(ctx context.Context, tx pgx.Tx, userID string, deviceID *int) error {
+	var online bool
+	var lastSeen time.Time
+	err := tx.QueryRow(ctx, `
+		SELECT online, last_seen_at FROM Connectivity WHERE user_id = $1 FOR UPDATE
+	`, userID).Scan(&online, &lastSeen)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	wasOffline := err == nil && !online
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO Connectivity (user_id, online, last_seen_at, last_device_id, changed_at)
+		VALUES ($1, true, now(), $2, now())
+		ON CONFLICT (user_id) DO UPDATE SET
+			online = true,
+			last_seen_at = now(),
+			last_device_id = COALESCE(EXCLUDED.last_device_id, Connectivity.last_device_id),
+			changed_at = CASE WHEN Connectivity.online THEN Connectivity.changed_at ELSE now() END
+	`, userID, deviceID)
+	if err != nil || !wasOffline {
+		return err
+	}
+
+	silence := int(math.Round(time.Since(lastSeen).Minutes()))
+	_, err = insertEvent(ctx, tx, Event{
+		UserID:      userID,
+		Type:        "Device_Online",
+		Name:        "Cane back online",
+		Description: "Back online after " + formatMinutes(silence) + " without status",
+		DeviceID:    deviceID,
+		Details: map[string]any{
+			"last_seen_at":    lastSeen,
+			"silence_minutes": silence,
+		},
+	})
+	return err
+}
+
+// runWatchdog marks silent users offline until the process exits.
+func runWatchdog() {
+	ticker := time.NewTicker(watchdogInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := markSilentOffline(context.Background()); err != nil {
+			log.Printf("[watchdog] checking connectivity failed: %v", err)
+		}
+	}
+}
+
+// markSilentOffline writes Device_Offline for every online user nothing has
+// been received from in the offline period. The UPDATE claims the rows, so
+// several API instances can run the watchdog without duplicating events.
+func markSilentOffline(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	after := deviceOfflineAfter()
+	rows, err := tx.Query(ctx, `
+		UPDATE Connectivity SET online = false, changed_at = now()
+		WHERE online AND last_seen_at < now() - make_interval(secs => $1)
+		RETURNING user_id, last_seen_at, last_device_id
+	`, after.Seconds())
+	if err != nil {
+		return err
+	}
+	type silent struct {
+		userID   string
+		lastSeen time.Time
+		deviceID *int
+	}
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (silent, error) {
+		var s silent
+		err := row.Scan(&s.userID, &s.lastSeen, &s.deviceID)
+		return s, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range users {
+		_, err := insertEvent(ctx, tx, Event{
+			UserID:      s.userID,
+			Type:        "Device_Offline",
+			Name:        "Cane offline",
+			Description: fmt.Sprintf("No status received for %s", formatMinutes(int(time.Since(s.lastSeen).Minutes()))),
+			DeviceID:    s.deviceID,
+			Details: map[string]any{
+				"last_seen_at":          s.lastSeen,
+				"offline_after_minutes": int(after.Minutes()),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -5,11 +5,21 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var DB *pgxpool.Pool
 
+// dbtx is satisfied by both the pool and a transaction, for helpers that may
+// run either way.
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 func ConnectDB() error {
 	var err error
 	dbUrl := os.Getenv("DATABASE_URL")
@@ -53,6 +63,252 @@ func runMigrations() error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_appointments_user_id ON Appointments(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_appointments_start_at ON Appointments(start_at ASC)`,
+		// Sessions now store an HMAC of the token. Rows still holding a bcrypt
+		// hash can't be looked up, so their owners sign in again.
+		`DELETE FROM Sessions WHERE token_hash LIKE '$2%'`,
+		`CREATE TABLE IF NOT EXISTS Devices (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			key_prefix TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			rotated_at TIMESTAMPTZ NULL,
+			last_used_at TIMESTAMPTZ NULL,
+			revoked_at TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_user_id ON Devices(user_id)`,
+		`ALTER TABLE Sessions ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE Sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE Sessions ADD COLUMN IF NOT EXISTS ip_address TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE Sessions ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NULL`,
+		`CREATE TABLE IF NOT EXISTS PasswordResets (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON PasswordResets(user_id)`,
+		// Accounts that existed before verification was introduced count as verified
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ NULL DEFAULT now()`,
+		`ALTER TABLE Users ALTER COLUMN email_verified_at DROP DEFAULT`,
+		`CREATE TABLE IF NOT EXISTS EmailVerifications (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			email TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id ON EmailVerifications(user_id)`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_secret TEXT NULL`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ NULL`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NULL`,
+		`CREATE TABLE IF NOT EXISTS RecoveryCodes (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			used_at TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON RecoveryCodes(user_id)`,
+		`CREATE TABLE IF NOT EXISTS LoginChallenges (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			token_hash TEXT NOT NULL UNIQUE,
+			session_name TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		`DELETE FROM LoginChallenges WHERE expires_at <= now()`,
+		`CREATE TABLE IF NOT EXISTS LoginThrottles (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			locked_until TIMESTAMPTZ NULL
+		)`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS avatar_key TEXT NULL`,
+		`CREATE TABLE IF NOT EXISTS MedicalProfiles (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			conditions TEXT[] NOT NULL DEFAULT '{}',
+			medications TEXT[] NOT NULL DEFAULT '{}',
+			allergies TEXT[] NOT NULL DEFAULT '{}',
+			blood_type TEXT NOT NULL DEFAULT '',
+			preferred_hospital TEXT NOT NULL DEFAULT '',
+			emergency_contacts JSONB NOT NULL DEFAULT '[]',
+			notes TEXT NOT NULL DEFAULT '',
+			updated_by UUID NULL REFERENCES Users(user_id) ON DELETE SET NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE TABLE IF NOT EXISTS Places (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			category TEXT NOT NULL DEFAULT 'other',
+			longitude DOUBLE PRECISION NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			radius REAL NULL,
+			address TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_places_user_id ON Places(user_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_places_user_home ON Places(user_id) WHERE category = 'home'`,
+		`INSERT INTO Places (user_id, name, category, longitude, latitude)
+		 SELECT user_id, 'Home', 'home', home_long, home_lat FROM Users
+		 ON CONFLICT (user_id) WHERE category = 'home' DO NOTHING`,
+		`ALTER TABLE Fences ADD COLUMN IF NOT EXISTS place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL`,
+		`ALTER TABLE Appointments ADD COLUMN IF NOT EXISTS place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL`,
+		`CREATE TABLE IF NOT EXISTS UserPreferences (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			units TEXT NULL,
+			language TEXT NULL,
+			timezone TEXT NULL,
+			notify_event_types TEXT[] NULL,
+			quiet_hours_start TIME NULL,
+			quiet_hours_end TIME NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`ALTER TYPE user_role ADD VALUE IF NOT EXISTS 'Admin'`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ NULL`,
+		`ALTER TABLE Users ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS AdminAudit (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			admin_user_id UUID NULL REFERENCES Users(user_id) ON DELETE SET NULL,
+			action TEXT NOT NULL,
+			target_user_id UUID NULL,
+			details JSONB NOT NULL DEFAULT '{}',
+			ip_address TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_admin_audit_target_user_id ON AdminAudit(target_user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_admin_audit_admin_user_id ON AdminAudit(admin_user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_admin_audit_created_at ON AdminAudit(created_at DESC)`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL`,
+		`ALTER TABLE Events ADD COLUMN IF NOT EXISTS device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ NULL`,
+		`UPDATE Stats SET received_at = created_at WHERE received_at IS NULL`,
+		`ALTER TABLE Stats ALTER COLUMN received_at SET DEFAULT now()`,
+		`ALTER TABLE Stats ALTER COLUMN received_at SET NOT NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_stats_device_recorded ON Stats(device_id, created_at) WHERE device_id IS NOT NULL`,
+		`ALTER TABLE Events ADD COLUMN IF NOT EXISTS details JSONB NULL`,
+		`CREATE TABLE IF NOT EXISTS FenceStates (
+			fence_id INTEGER PRIMARY KEY REFERENCES Fences(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			inside BOOLEAN NOT NULL,
+			pending SMALLINT NOT NULL DEFAULT 0,
+			last_recorded_at TIMESTAMPTZ NOT NULL,
+			longitude DOUBLE PRECISION NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			radius REAL NOT NULL,
+			changed_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_fence_states_user_id ON FenceStates(user_id)`,
+		`ALTER TABLE UserPreferences ADD COLUMN IF NOT EXISTS battery_thresholds SMALLINT[] NULL`,
+		`CREATE TABLE IF NOT EXISTS BatteryStates (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			alerted_threshold SMALLINT NULL,
+			last_battery SMALLINT NOT NULL,
+			last_recorded_at TIMESTAMPTZ NOT NULL
+		)`,
+		`ALTER TYPE event_type ADD VALUE IF NOT EXISTS 'Heart_Rate_Alert'`,
+		`CREATE TABLE IF NOT EXISTS HeartRateRules (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			low_bpm SMALLINT NOT NULL,
+			resting_max_bpm SMALLINT NOT NULL,
+			high_bpm SMALLINT NOT NULL,
+			sustained_minutes SMALLINT NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE TABLE IF NOT EXISTS HeartRateStates (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			active_rules TEXT[] NOT NULL DEFAULT '{}',
+			last_recorded_at TIMESTAMPTZ NOT NULL
+		)`,
+		`ALTER TYPE event_type ADD VALUE IF NOT EXISTS 'Device_Offline'`,
+		`ALTER TYPE event_type ADD VALUE IF NOT EXISTS 'Device_Online'`,
+		`CREATE TABLE IF NOT EXISTS Connectivity (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			online BOOLEAN NOT NULL,
+			last_seen_at TIMESTAMPTZ NOT NULL,
+			last_device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL,
+			changed_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_connectivity_online_last_seen ON Connectivity(last_seen_at) WHERE online`,
+		fmt.Sprintf(`INSERT INTO Connectivity (user_id, online, last_seen_at, changed_at)
+		 SELECT user_id, max(received_at) > now() - make_interval(secs => %d), max(received_at), max(received_at)
+		 FROM Stats GROUP BY user_id
+		 ON CONFLICT (user_id) DO NOTHING`, int(deviceOfflineAfter().Seconds())),
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS accuracy REAL NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS speed REAL NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS heading REAL NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS altitude REAL NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS satellites SMALLINT NULL`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS location_source TEXT NULL`,
+		`CREATE TABLE IF NOT EXISTS Segments (
+			id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			kind TEXT NOT NULL,
+			start_at TIMESTAMPTZ NOT NULL,
+			end_at TIMESTAMPTZ NOT NULL,
+			longitude DOUBLE PRECISION NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			end_longitude DOUBLE PRECISION NULL,
+			end_latitude DOUBLE PRECISION NULL,
+			points INTEGER NOT NULL,
+			distance_meters DOUBLE PRECISION NOT NULL DEFAULT 0,
+			place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL,
+			fence_id INTEGER NULL REFERENCES Fences(id) ON DELETE SET NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_segments_user_start ON Segments(user_id, start_at)`,
+		`CREATE TABLE IF NOT EXISTS SegmentStates (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			segment_id INTEGER NULL REFERENCES Segments(id) ON DELETE SET NULL,
+			pending SMALLINT NOT NULL DEFAULT 0,
+			pending_distance DOUBLE PRECISION NOT NULL DEFAULT 0,
+			candidate_start_at TIMESTAMPTZ NULL,
+			candidate_longitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+			candidate_latitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+			candidate_points INTEGER NOT NULL DEFAULT 0,
+			candidate_distance DOUBLE PRECISION NOT NULL DEFAULT 0,
+			last_recorded_at TIMESTAMPTZ NOT NULL,
+			last_longitude DOUBLE PRECISION NOT NULL,
+			last_latitude DOUBLE PRECISION NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS DailySummaries (
+			user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			timezone TEXT NOT NULL,
+			readings INTEGER NOT NULL,
+			distance_meters DOUBLE PRECISION NOT NULL,
+			active_minutes INTEGER NOT NULL,
+			home_minutes INTEGER NOT NULL,
+			outdoor_minutes INTEGER NOT NULL,
+			trips INTEGER NOT NULL,
+			avg_heart_rate REAL NULL,
+			max_heart_rate SMALLINT NULL,
+			charge_cycles REAL NOT NULL,
+			computed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, day)
+		)`,
+		// Segmentation states that already exist replayed their history when
+		// they were created; new ones leave it to the backfill job.
+		`ALTER TABLE SegmentStates ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+		`ALTER TABLE SegmentStates ALTER COLUMN started_at DROP DEFAULT`,
+		`ALTER TABLE SegmentStates ADD COLUMN IF NOT EXISTS backfilled BOOLEAN NOT NULL DEFAULT true`,
+		`ALTER TABLE SegmentStates ALTER COLUMN backfilled SET DEFAULT false`,
+		`CREATE TABLE IF NOT EXISTS ActivityWatermarks (
+			user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+			timezone TEXT NOT NULL,
+			summarized_through DATE NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_stats_user_created ON Stats(user_id, created_at)`,
+		`ALTER TABLE Stats ADD COLUMN IF NOT EXISTS skin_contact BOOLEAN NULL`,
 	}
 	for _, m := range migrations {
 		if _, err := DB.Exec(context.Background(), m); err != nil {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Device API keys let the cane hardware post telemetry without a human
+// session. Keys are shown once when issued or rotated and stored as a keyed
+// hash, like session tokens.
+//
+// A linked caregiver may issue, rotate and revoke keys for a cane user, as
+// they are often the one setting the cane up.
+
+const deviceKeyPrefix = "ppd_"
+
+type Device struct {
+	ID         int        `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	KeyPrefix  string     `json:"key_prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type DeviceKeyResponse struct {
+	Device
+	APIKey string `json:"api_key"`
+}
+
+type CreateDeviceRequest struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+type DeviceRequest struct {
+	UserID string `json:"user_id"`
+	ID     int    `json:"id"`
+}
+
+var errInvalidDeviceKey = errors.New("invalid device key")
+
+const deviceColumns = `id, user_id, name, key_prefix, created_at, rotated_at, last_used_at, revoked_at`
+
+func scanDevice(row pgx.Row, d *Device) error {
+	return row.Scan(&d.ID, &d.UserID, &d.Name, &d.KeyPrefix, &d.CreatedAt, &d.RotatedAt, &d.LastUsedAt, &d.RevokedAt)
+}
+
+// generateDeviceKey returns a new API key and the prefix shown to users so
+// they can tell keys apart.
+func generateDeviceKey() (string, string, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return deviceKeyPrefix + token, token[:8], nil
+}
+
+// POST /devices - Issue an API key for a cane user's device
+func createDevice(c echo.Context) error {
+	var req CreateDeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "name is required"})
+	}
+
+	key, prefix, err := generateDeviceKey()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to generate device key"})
+	}
+
+	ctx := c.Request().Context()
+	sql := `
+		INSERT INTO Devices (user_id, name, key_prefix, key_hash)
+		SELECT user_id, $2, $3, $4 FROM Users WHERE user_id = $1 AND type = 'Cane_User'
+		RETURNING ` + deviceColumns
+
+	var resp DeviceKeyResponse
+	err = scanDevice(DB.QueryRow(ctx, sql, userID, req.Name, prefix, hashToken(key)), &resp.Device)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "devices can only be issued for cane users"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to create device"})
+	}
+	resp.APIKey = key
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// GET /devices - List a cane user's devices, including revoked ones
+func listDevices(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	rows, err := DB.Query(ctx, `SELECT `+deviceColumns+` FROM Devices WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch devices"})
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := scanDevice(rows, &d); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to parse device"})
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to read devices"})
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// POST /devices/rotate - Replace a device's API key; the old key stops working immediately
+func rotateDevice(c echo.Context) error {
+	var req DeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid id is required"})
+	}
+
+	key, prefix, err := generateDeviceKey()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to generate device key"})
+	}
+
+	ctx := c.Request().Context()
+	sql := `
+		UPDATE Devices SET key_prefix = $1, key_hash = $2, rotated_at = now()
+		WHERE user_id = $3 AND id = $4 AND revoked_at IS NULL
+		RETURNING ` + deviceColumns
+
+	var resp DeviceKeyResponse
+	err = scanDevice(DB.QueryRow(ctx, sql, prefix, hashToken(key), userID, req.ID), &resp.Device)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "device not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to rotate device key"})
+	}
+	resp.APIKey = key
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// DELETE /devices - Revoke a device. The row is kept so past Stats and Events
+// still show which device submitted them.
+func revokeDevice(c echo.Context) error {
+	var req DeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid id is required"})
+	}
+
+	ctx := c.Request().Context()
+	tag, err := DB.Exec(ctx, `UPDATE Devices SET revoked_at = now() WHERE user_id = $1 AND id = $2 AND revoked_at IS NULL`, userID, req.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to revoke device"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "device not found"})
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "device revoked"})
+}
+
+// findDevice returns the active device holding key.
+func findDevice(ctx context.Context, key string) (Device, error) {
+	var d Device
+	if !strings.HasPrefix(key, deviceKeyPrefix) {
+		return d, errInvalidDeviceKey
+	}
+	sql := `
+		SELECT ` + deviceColumns + ` FROM Devices
+		WHERE key_hash = $1 AND revoked_at IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM Users WHERE user_id = Devices.user_id AND disabled_at IS NOT NULL)
+	`
+	err := scanDevice(DB.QueryRow(ctx, sql, hashToken(key)), &d)
+	if err == pgx.ErrNoRows {
+		return d, errInvalidDeviceKey
+	} else if err != nil {
+		return d, err
+	}
+
+	// last_used_at only needs minute resolution, so skip most writes
+	_, err = DB.Exec(ctx, `
+		UPDATE Devices SET last_used_at = now()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')
+	`, d.ID)
+	return d, err
+}
+
+// ingestUserID resolves the user and device for an ingest route. Devices may
+// only submit data for the cane user they were issued to. Session callers may
+// only submit their own: a caregiver reads a cane user's telemetry but never
+// writes it, and has no device.
+func ingestUserID(c echo.Context, requested string) (string, *int, error) {
+	if device := currentDevice(c); device != nil {
+		if strings.TrimSpace(requested) != "" && !sameUser(requested, device.UserID) {
+			return "", nil, errForbidden
+		}
+		return device.UserID, &device.ID, nil
+	}
+	userID, err := selfUserID(c, requested)
+	return userID, nil, err
+}
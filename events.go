@@ -15,7 +15,14 @@ type Event struct {
 	Type        string    `json:"type"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
+	DeviceID    *int      `json:"device_id"`
 	CreatedAt   time.Time `json:"created_at"`
+
+	// Context recorded with server-generated events, e.g. the fence that was crossed
+	Details map[string]any `json:"details,omitempty"`
+
+	// Set on SOS and Fall events only
+	MedicalProfile *MedicalProfile `json:"medical_profile,omitempty"`
 }
 
 type EventCreateRequest struct {
@@ -37,10 +44,13 @@ type GetEventsByTypeRequest struct {
 }
 
 type EventResponse struct {
-	EventID     int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
+	EventID     int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Details     map[string]any `json:"details,omitempty"`
+
+	MedicalProfile *MedicalProfile `json:"medical_profile,omitempty"`
 }
 
 func createEvent(c echo.Context) error {
@@ -50,33 +60,61 @@ func createEvent(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
 	}
 
-	sql := `
-		INSERT INTO Events (user_id, type, name, description)
-		VALUES ($1, $2, $3, $4) 
-		RETURNING id, user_id, type, name, description, created_at
-	`
-
-	var newEvent Event
-	err := DB.QueryRow(context.Background(), sql, req.UserID, req.Type, req.Name, req.Description).Scan(
-		&newEvent.EventID,
-		&newEvent.UserID,
-		&newEvent.Type,
-		&newEvent.Name,
-		&newEvent.Description,
-		&newEvent.CreatedAt,
-	)
+	userID, deviceID, err := ingestUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
 
+	newEvent, err := insertEvent(context.Background(), DB, Event{
+		UserID:      userID,
+		Type:        req.Type,
+		Name:        req.Name,
+		Description: req.Description,
+		DeviceID:    deviceID,
+	})
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create event"})
 	}
 
-	return c.JSON(http.StatusCreated, newEvent)
+	created := []Event{newEvent}
+	if err := attachMedicalProfiles(context.Background(), created); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load medical profile"})
+	}
+
+	return c.JSON(http.StatusCreated, created[0])
+}
+
+// insertEvent stores e and returns it as saved. A zero CreatedAt means now;
+// events derived from readings pass the time the reading was taken.
+func insertEvent(ctx context.Context, db dbtx, e Event) (Event, error) {
+	var createdAt *time.Time
+	if !e.CreatedAt.IsZero() {
+		createdAt = &e.CreatedAt
+	}
+
+	sql := `
+		INSERT INTO Events (user_id, type, name, description, device_id, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, now()))
+		RETURNING id, user_id, type, name, description, device_id, details, created_at
+	`
+	var saved Event
+	err := db.QueryRow(ctx, sql, e.UserID, e.Type, e.Name, e.Description, e.DeviceID, e.Details, createdAt).Scan(
+		&saved.EventID,
+		&saved.UserID,
+		&saved.Type,
+		&saved.Name,
+		&saved.Description,
+		&saved.DeviceID,
+		&saved.Details,
+		&saved.CreatedAt,
+	)
+	return saved, err
 }
 
 func getEvents(c echo.Context) error {
-	userID := c.QueryParam("user_id")
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id query parameter is required"})
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
 	}
 	quantityStr := c.QueryParam("quantity")
 	quantity, err := strconv.Atoi(quantityStr)
@@ -85,7 +123,7 @@ func getEvents(c echo.Context) error {
 	}
 
 	sql := `
-		SELECT id, user_id, type, name, description, created_at
+		SELECT id, user_id, type, name, description, device_id, details, created_at
 		FROM Events
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -101,7 +139,7 @@ func getEvents(c echo.Context) error {
 	var events []Event
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.EventID, &event.UserID, &event.Type, &event.Name, &event.Description, &event.CreatedAt); err != nil {
+		if err := rows.Scan(&event.EventID, &event.UserID, &event.Type, &event.Name, &event.Description, &event.DeviceID, &event.Details, &event.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan event"})
 		}
 		events = append(events, event)
@@ -111,6 +149,10 @@ func getEvents(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over events"})
 	}
 
+	if err := attachMedicalProfiles(context.Background(), events); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load medical profile"})
+	}
+
 	return c.JSON(http.StatusOK, events)
 }
 
@@ -121,14 +163,19 @@ func getEventsByType(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
 	}
 
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+
 	sql := `
-		SELECT id, name, description, created_at
+		SELECT id, name, description, details, created_at
 		FROM Events
 		WHERE user_id = $1 AND type = $2
 		ORDER BY created_at DESC
 		LIMIT $3
 	`
-	rows, err := DB.Query(context.Background(), sql, req.UserID, req.Type, req.Quantity)
+	rows, err := DB.Query(context.Background(), sql, userID, req.Type, req.Quantity)
 
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to retrieve events"})
@@ -138,7 +185,7 @@ func getEventsByType(c echo.Context) error {
 	var events []EventResponse
 	for rows.Next() {
 		var event EventResponse
-		if err := rows.Scan(&event.EventID, &event.Name, &event.Description, &event.CreatedAt); err != nil {
+		if err := rows.Scan(&event.EventID, &event.Name, &event.Description, &event.Details, &event.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan event"})
 		}
 		events = append(events, event)
@@ -148,5 +195,17 @@ func getEventsByType(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over events"})
 	}
 
+	if emergencyEventTypes[req.Type] && len(events) > 0 {
+		profile, err := loadMedicalProfile(context.Background(), userID)
+		if err != nil && err != errNotCaneUser {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load medical profile"})
+		}
+		if err == nil {
+			for i := range events {
+				events[i].MedicalProfile = &profile
+			}
+		}
+	}
+
 	return c.JSON(http.StatusOK, events)
 }
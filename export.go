@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Location history export for use in other mapping tools. The trail is
+// streamed straight from the database, so long ranges don't have to fit in
+// memory. Formats that list each attribute separately (GeoJSON coordinate
+// properties, KML gx:Track) read the range once per list, inside one
+// read-only snapshot so every pass sees the same rows.
+//
+// Timestamps are UTC. Heart rate and battery are included on request:
+// GPX uses the Garmin TrackPointExtension for heart rate and a PathPal
+// namespace for battery; KML uses gx:SimpleArrayData.
+
+const maxExportDays = 31
+
+const (
+	exportGeoJSON = "geojson"
+	exportGPX     = "gpx"
+	exportKML     = "kml"
+)
+
+var exportContentTypes = map[string]string{
+	exportGeoJSON: "application/geo+json",
+	exportGPX:     "application/gpx+xml",
+	exportKML:     "application/vnd.google-earth.kml+xml",
+}
+
+type exportPoint struct {
+	RecordedAt time.Time
+	Longitude  float64
+	Latitude   float64
+	Altitude   *float64
+	HeartRate  *int
+	Battery    int
+}
+
+type exportOptions struct {
+	Name      string
+	HeartRate bool
+	Battery   bool
+}
+
+// exportTrail runs the trail query and calls fn for every point, oldest first.
+type exportTrail func(fn func(p exportPoint) error) error
+
+// exportFormat picks the format from ?format= or, failing that, the Accept
+// header. An empty result means the requested format is not supported.
+func exportFormat(c echo.Context) string {
+	if f := strings.ToLower(c.QueryParam("format")); f != "" {
+		if _, ok := exportContentTypes[f]; ok {
+			return f
+		}
+		return ""
+	}
+	return exportFormatForAccept(c.Request().Header.Get(echo.HeaderAccept))
+}
+
+// exportFormatForAccept returns the format the Accept header gives the
+// highest q-value, judging each format by the most specific range that
+// matches it. A range with q=0 refuses a format; when nothing is accepted
+// outright, the first format the header doesn't mention is used.
+func exportFormatForAccept(accept string) string {
+	formats := []string{exportGeoJSON, exportGPX, exportKML}
+	if strings.TrimSpace(accept) == "" {
+		return exportGeoJSON
+	}
+
+	quality := map[string]float64{}
+	specificity := map[string]int{}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		for _, f := range formats {
+			level := acceptSpecificity(mediaType, exportContentTypes[f])
+			if level > specificity[f] {
+				quality[f], specificity[f] = q, level
+			}
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, f := range formats {
+		if quality[f] > bestQ {
+			best, bestQ = f, quality[f]
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for _, f := range formats {
+		if specificity[f] == 0 {
+			return f
+		}
+	}
+	return ""
+}
+
+// acceptSpecificity reports how closely a media range matches contentType:
+// 0 for no match, then */*, type/* and an exact match.
+func acceptSpecificity(mediaRange, contentType string) int {
+	switch {
+	case mediaRange == contentType:
+		return 3
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	case mediaRange == "*/*":
+		return 1
+	}
+	return 0
+}
+
+// GET /location/export?start_time=&end_time=[&format=geojson|gpx|kml][&include=heart_rate,battery][&max_accuracy=][&user_id=]
+func exportLocations(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	format := exportFormat(c)
+	if format == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "format must be geojson, gpx or kml"})
+	}
+
+	if c.QueryParam("start_time") == "" || c.QueryParam("end_time") == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "start_time and end_time are required"})
+	}
+	start, err := time.Parse(iso8601Format, c.QueryParam("start_time"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid start_time format, please use ISO 8601 format (e.g., 2025-11-14T00:00:00Z)",
+		})
+	}
+	end, err := time.Parse(iso8601Format, c.QueryParam("end_time"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid end_time format, please use ISO 8601 format (e.g., 2025-11-14T23:59:59Z)",
+		})
+	}
+	if end.Before(start) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "end_time must be after start_time"})
+	}
+	if end.Sub(start) > maxExportDays*24*time.Hour {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "exports are limited to 31 days"})
+	}
+
+	var maxAccuracy *float64
+	if v := c.QueryParam("max_accuracy"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "max_accuracy must be a positive number of meters"})
+		}
+		maxAccuracy = &n
+	}
+
+	var opts exportOptions
+	for _, field := range strings.Split(c.QueryParam("include"), ",") {
+		switch strings.TrimSpace(field) {
+		case "":
+		case "heart_rate":
+			opts.HeartRate = true
+		case "battery":
+			opts.Battery = true
+		default:
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "include may list heart_rate and battery"})
+		}
+	}
+
+	ctx := c.Request().Context()
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch user"})
+	}
+	opts.Name = fmt.Sprintf("%s, %s to %s", user.Name, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+
+	tx, err := DB.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to export locations"})
+	}
+	defer tx.Rollback(context.Background())
+
+	const trailWhere = `
+		WHERE user_id = $1
+		  AND created_at >= $2
+		  AND created_at <= $3
+		  AND ($4::float8 IS NULL OR accuracy IS NULL OR accuracy <= $4)`
+	trail := func(fn func(p exportPoint) error) error {
+		rows, err := tx.Query(ctx, `
+			SELECT created_at, longitude, latitude, altitude, heart_rate, battery
+			FROM stats`+trailWhere+`
+			ORDER BY created_at
+		`, userID, start, end, maxAccuracy)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p exportPoint
+			if err := rows.Scan(&p.RecordedAt, &p.Longitude, &p.Latitude, &p.Altitude, &p.HeartRate, &p.Battery); err != nil {
+				return err
+			}
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	// GeoJSON writes fewer than two points differently; counting that far
+	// is enough to tell
+	var points int
+	if format == exportGeoJSON {
+		err := tx.QueryRow(ctx, `SELECT count(*) FROM (SELECT 1 FROM stats`+trailWhere+` LIMIT 2) head`,
+			userID, start, end, maxAccuracy).Scan(&points)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to export locations"})
+		}
+	}
+
+	filename := fmt.Sprintf("pathpal-%s-%s.%s", start.UTC().Format("20060102"), end.UTC().Format("20060102"), format)
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, exportContentTypes[format])
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriterSize(res, 32*1024)
+	switch format {
+	case exportGPX:
+		err = writeGPX(w, trail, opts)
+	case exportKML:
+		err = writeKML(w, trail, opts)
+	default:
+		err = writeGeoJSON(w, trail, points, opts)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// Headers are gone already; all that's left is to cut the body short
+		log.Printf("[export] exporting locations for %s failed: %v", userID, err)
+	}
+	return nil
+}
+
+func exportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func exportFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writeGeoJSON writes a FeatureCollection holding the trail as one LineString,
+// with per-point times (and heart rates and battery levels if asked for)
+// under properties.coordinateProperties, as most GeoJSON tools expect. A
+// LineString needs two positions, so a single reading is written as a Point
+// and an empty range as an empty collection. points is the number of points
+// in the trail, or 2 for any more than that.
+func writeGeoJSON(w io.Writer, trail exportTrail, points int, opts exportOptions) error {
+	name, err := json.Marshal(opts.Name)
+	if err != nil {
+		return err
+	}
+
+	switch points {
+	case 0:
+		_, err := io.WriteString(w, `{"type":"FeatureCollection","features":[]}`+"\n")
+		return err
+	case 1:
+		return trail(func(p exportPoint) error {
+			return writeGeoJSONPoint(w, p, name, opts)
+		})
+	}
+
+	io.WriteString(w, `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":`)
+	err = writeJSONList(w, trail, geoJSONPosition)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, `},"properties":{"name":%s,"coordinateProperties":{"times":`, name)
+	err = writeJSONList(w, trail, func(p exportPoint) string {
+		return `"` + exportTime(p.RecordedAt) + `"`
+	})
+	if err != nil {
+		return err
+	}
+	if opts.HeartRate {
+		io.WriteString(w, `,"heart_rates":`)
+		err := writeJSONList(w, trail, func(p exportPoint) string {
+			if p.HeartRate == nil {
+				return "null"
+			}
+			return strconv.Itoa(*p.HeartRate)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Battery {
+		io.WriteString(w, `,"batteries":`)
+		err := writeJSONList(w, trail, func(p exportPoint) string {
+			return strconv.Itoa(p.Battery)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "}}}]}\n")
+	return err
+}
+
+func writeGeoJSONPoint(w io.Writer, p exportPoint, name []byte, opts exportOptions) error {
+	fmt.Fprintf(w, `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":%s},`, geoJSONPosition(p))
+	fmt.Fprintf(w, `"properties":{"name":%s,"time":"%s"`, name, exportTime(p.RecordedAt))
+	if opts.HeartRate {
+		hr := "null"
+		if p.HeartRate != nil {
+			hr = strconv.Itoa(*p.HeartRate)
+		}
+		fmt.Fprintf(w, `,"heart_rate":%s`, hr)
+	}
+	if opts.Battery {
+		fmt.Fprintf(w, `,"battery":%d`, p.Battery)
+	}
+	_, err := io.WriteString(w, "}}]}\n")
+	return err
+}
+
+func geoJSONPosition(p exportPoint) string {
+	coord := "[" + exportFloat(p.Longitude) + "," + exportFloat(p.Latitude)
+	if p.Altitude != nil {
+		coord += "," + exportFloat(*p.Altitude)
+	}
+	return coord + "]"
+}
+
+// writeJSONList writes one JSON array with an element per point.
+func writeJSONList(w io.Writer, trail exportTrail, value func(p exportPoint) string) error {
+	io.WriteString(w, "[")
+	first := true
+	err := trail(func(p exportPoint) error {
+		sep := ","
+		if first {
+			sep, first = "", false
+		}
+		_, err := io.WriteString(w, sep+value(p))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// writeGPX writes a GPX 1.1 document with the trail as a single track segment.
+func writeGPX(w io.Writer, trail exportTrail, opts exportOptions) error {
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<gpx version="1.1" creator="PathPal" xmlns="http://www.topografix.com/GPX/1/1"`+
+		` xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1"`+
+		` xmlns:pathpal="https://senseway.ca/xmlschemas/pathpal/v1">`+"\n")
+	fmt.Fprintf(w, "  <metadata><name>%s</name><time>%s</time></metadata>\n", xmlEscape(opts.Name), exportTime(time.Now()))
+	fmt.Fprintf(w, "  <trk><name>%s</name><trkseg>\n", xmlEscape(opts.Name))
+
+	err := trail(func(p exportPoint) error {
+		var b strings.Builder
+		fmt.Fprintf(&b, `    <trkpt lat="%s" lon="%s">`, exportFloat(p.Latitude), exportFloat(p.Longitude))
+		if p.Altitude != nil {
+			fmt.Fprintf(&b, "<ele>%s</ele>", exportFloat(*p.Altitude))
+		}
+		fmt.Fprintf(&b, "<time>%s</time>", exportTime(p.RecordedAt))
+		hr := opts.HeartRate && p.HeartRate != nil
+		if hr || opts.Battery {
+			b.WriteString("<extensions>")
+			if hr {
+				fmt.Fprintf(&b, "<gpxtpx:TrackPointExtension><gpxtpx:hr>%d</gpxtpx:hr></gpxtpx:TrackPointExtension>", *p.HeartRate)
+			}
+			if opts.Battery {
+				fmt.Fprintf(&b, "<pathpal:battery>%d</pathpal:battery>", p.Battery)
+			}
+			b.WriteString("</extensions>")
+		}
+		b.WriteString("</trkpt>\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "  </trkseg></trk>\n</gpx>\n")
+	return err
+}
+
+// writeKML writes a KML 2.2 document with the trail as a gx:Track. The track
+// lists every <when>, then every <gx:coord>, then each extra value list.
+func writeKML(w io.Writer, trail exportTrail, opts exportOptions) error {
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">`+"\n")
+	fmt.Fprintf(w, "<Document>\n  <name>%s</name>\n", xmlEscape(opts.Name))
+	if opts.HeartRate || opts.Battery {
+		io.WriteString(w, `  <Schema id="pathpal">`)
+		if opts.HeartRate {
+			io.WriteString(w, `<gx:SimpleArrayField name="heart_rate" type="int"><displayName>Heart rate (bpm)</displayName></gx:SimpleArrayField>`)
+		}
+		if opts.Battery {
+			io.WriteString(w, `<gx:SimpleArrayField name="battery" type="int"><displayName>Battery (%)</displayName></gx:SimpleArrayField>`)
+		}
+		io.WriteString(w, "</Schema>\n")
+	}
+	fmt.Fprintf(w, "  <Placemark>\n    <name>%s</name>\n    <gx:Track>\n", xmlEscape(opts.Name))
+
+	err := trail(func(p exportPoint) error {
+		_, err := fmt.Fprintf(w, "      <when>%s</when>\n", exportTime(p.RecordedAt))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = trail(func(p exportPoint) error {
+		alt := 0.0
+		if p.Altitude != nil {
+			alt = *p.Altitude
+		}
+		_, err := fmt.Fprintf(w, "      <gx:coord>%s %s %s</gx:coord>\n", exportFloat(p.Longitude), exportFloat(p.Latitude), exportFloat(alt))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.HeartRate || opts.Battery {
+		io.WriteString(w, "      <ExtendedData><SchemaData schemaUrl=\"#pathpal\">\n")
+		if opts.HeartRate {
+			io.WriteString(w, "        <gx:SimpleArrayData name=\"heart_rate\">")
+			err := trail(func(p exportPoint) error {
+				value := ""
+				if p.HeartRate != nil {
+					value = strconv.Itoa(*p.HeartRate)
+				}
+				_, err := fmt.Fprintf(w, "<gx:value>%s</gx:value>", value)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			io.WriteString(w, "</gx:SimpleArrayData>\n")
+		}
+		if opts.Battery {
+			io.WriteString(w, "        <gx:SimpleArrayData name=\"battery\">")
+			err := trail(func(p exportPoint) error {
+				_, err := fmt.Fprintf(w, "<gx:value>%d</gx:value>", p.Battery)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			io.WriteString(w, "</gx:SimpleArrayData>\n")
+		}
+		io.WriteString(w, "      </SchemaData></ExtendedData>\n")
+	}
+
+	_, err = io.WriteString(w, "    </gx:Track>\n  </Placemark>\n</Document>\n</kml>\n")
+	return err
+}
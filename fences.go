@@ -22,6 +22,7 @@ type Fence struct {
 	StartsAt   *time.Time `json:"starts_at"`
 	EndsAt     *time.Time `json:"ends_at"`
 	TimedTitle string     `json:"timed_title"`
+	PlaceID    *int       `json:"place_id"`
 	CreatedAt  time.Time  `json:"created_at"`
 }
 
@@ -35,6 +36,7 @@ type CreateFenceRequest struct {
 	StartsAt   *time.Time `json:"starts_at"`
 	EndsAt     *time.Time `json:"ends_at"`
 	TimedTitle string     `json:"timed_title"`
+	PlaceID    *int       `json:"place_id"` // takes coordinates, and radius/name if unset, from a place
 }
 
 type UpdateFenceRequest struct {
@@ -49,6 +51,7 @@ type UpdateFenceRequest struct {
 	StartsAt   *time.Time `json:"starts_at"`
 	EndsAt     *time.Time `json:"ends_at"`
 	TimedTitle *string    `json:"timed_title"`
+	PlaceID    *int       `json:"place_id"` // moves the fence to a place, taking its radius if unset; explicit coordinates detach it
 }
 
 type ListFencesRequest struct {
@@ -62,6 +65,30 @@ func createFence(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
 
+	// Caregivers set fences up for the cane users they look after
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+
+	ctx := c.Request().Context()
+	if req.PlaceID != nil {
+		place, err := loadPlace(ctx, userID, *req.PlaceID)
+		if err == errPlaceNotFound {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+		}
+		req.Longitude, req.Latitude = place.Longitude, place.Latitude
+		if req.Radius == 0 && place.Radius != nil {
+			req.Radius = *place.Radius
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			req.Name = place.Name
+		}
+	}
+
 	if err := req.Validate(); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
 	}
@@ -71,15 +98,14 @@ func createFence(c echo.Context) error {
 		enabled = *req.Enabled
 	}
 
-	ctx := c.Request().Context()
 	sql := `
-		INSERT INTO Fences (user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, created_at
+		INSERT INTO Fences (user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id, created_at
 	`
 
 	var fence Fence
-	err := DB.QueryRow(ctx, sql, req.UserID, req.Name, enabled, req.Longitude, req.Latitude, req.Radius, req.StartsAt, req.EndsAt, req.TimedTitle).Scan(
+	err = DB.QueryRow(ctx, sql, req.UserID, req.Name, enabled, req.Longitude, req.Latitude, req.Radius, req.StartsAt, req.EndsAt, req.TimedTitle, req.PlaceID).Scan(
 		&fence.FenceID,
 		&fence.UserID,
 		&fence.Name,
@@ -90,6 +116,7 @@ func createFence(c echo.Context) error {
 		&fence.StartsAt,
 		&fence.EndsAt,
 		&fence.TimedTitle,
+		&fence.PlaceID,
 		&fence.CreatedAt,
 	)
 	if err != nil {
@@ -100,9 +127,9 @@ func createFence(c echo.Context) error {
 }
 
 func listFences(c echo.Context) error {
-	userID := strings.TrimSpace(c.QueryParam("user_id"))
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user id is required"})
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	var fenceID *int
@@ -118,10 +145,10 @@ func listFences(c echo.Context) error {
 		args []any
 	)
 	if fenceID != nil {
-		sql = `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, created_at FROM Fences WHERE user_id = $1 AND id = $2 ORDER BY created_at DESC`
+		sql = `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id, created_at FROM Fences WHERE user_id = $1 AND id = $2 ORDER BY created_at DESC`
 		args = []any{userID, *fenceID}
 	} else {
-		sql = `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, created_at FROM Fences WHERE user_id = $1 ORDER BY created_at DESC`
+		sql = `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id, created_at FROM Fences WHERE user_id = $1 ORDER BY created_at DESC`
 		args = []any{userID}
 	}
 
@@ -134,7 +161,7 @@ func listFences(c echo.Context) error {
 	var fences []Fence
 	for rows.Next() {
 		var f Fence
-		if err := rows.Scan(&f.FenceID, &f.UserID, &f.Name, &f.Enabled, &f.Longitude, &f.Latitude, &f.Radius, &f.StartsAt, &f.EndsAt, &f.TimedTitle, &f.CreatedAt); err != nil {
+		if err := rows.Scan(&f.FenceID, &f.UserID, &f.Name, &f.Enabled, &f.Longitude, &f.Latitude, &f.Radius, &f.StartsAt, &f.EndsAt, &f.TimedTitle, &f.PlaceID, &f.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to parse fence data"})
 		}
 		fences = append(fences, f)
@@ -154,10 +181,11 @@ func updateFence(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
 
-	userID := strings.TrimSpace(req.UserID)
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user id is required"})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
+	req.UserID = userID
 	if req.ID == nil || *req.ID <= 0 {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid fence id is required"})
 	}
@@ -168,10 +196,9 @@ func updateFence(c echo.Context) error {
 	}
 
 	ctx := c.Request().Context()
-	selectSQL := `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, created_at FROM Fences WHERE user_id = $1 AND id = $2`
+	selectSQL := `SELECT id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id, created_at FROM Fences WHERE user_id = $1 AND id = $2`
 
 	var current Fence
-	var err error
 	err = DB.QueryRow(ctx, selectSQL, userID, fenceID).Scan(
 		&current.FenceID,
 		&current.UserID,
@@ -183,6 +210,7 @@ func updateFence(c echo.Context) error {
 		&current.StartsAt,
 		&current.EndsAt,
 		&current.TimedTitle,
+		&current.PlaceID,
 		&current.CreatedAt,
 	)
 	if err == pgx.ErrNoRows {
@@ -203,6 +231,22 @@ func updateFence(c echo.Context) error {
 	if req.Latitude != nil {
 		current.Latitude = *req.Latitude
 	}
+	if req.Longitude != nil || req.Latitude != nil {
+		current.PlaceID = nil
+	}
+	if req.PlaceID != nil {
+		place, err := loadPlace(ctx, userID, *req.PlaceID)
+		if err == errPlaceNotFound {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+		}
+		current.Longitude, current.Latitude = place.Longitude, place.Latitude
+		if req.Radius == nil && place.Radius != nil {
+			current.Radius = *place.Radius
+		}
+		current.PlaceID = &place.ID
+	}
 	if req.Radius != nil {
 		current.Radius = *req.Radius
 	}
@@ -218,9 +262,9 @@ func updateFence(c echo.Context) error {
 	updateSQL := `
 		UPDATE Fences
 		SET name = $1, enabled = $2, longitude = $3, latitude = $4, radius = $5,
-		    starts_at = $6, ends_at = $7, timed_title = $8
-		WHERE user_id = $9 AND id = $10
-		RETURNING id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, created_at
+		    starts_at = $6, ends_at = $7, timed_title = $8, place_id = $9
+		WHERE user_id = $10 AND id = $11
+		RETURNING id, user_id, name, enabled, longitude, latitude, radius, starts_at, ends_at, timed_title, place_id, created_at
 	`
 
 	err = DB.QueryRow(ctx, updateSQL,
@@ -232,6 +276,7 @@ func updateFence(c echo.Context) error {
 		current.StartsAt,
 		current.EndsAt,
 		current.TimedTitle,
+		current.PlaceID,
 		userID,
 		fenceID,
 	).Scan(
@@ -245,6 +290,7 @@ func updateFence(c echo.Context) error {
 		&current.StartsAt,
 		&current.EndsAt,
 		&current.TimedTitle,
+		&current.PlaceID,
 		&current.CreatedAt,
 	)
 	if err == pgx.ErrNoRows {
@@ -264,9 +310,9 @@ func deleteFence(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
-	userID := strings.TrimSpace(req.UserID)
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user id is required"})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 	if req.ID <= 0 {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid fence id is required"})
@@ -322,7 +368,7 @@ func (r *UpdateFenceRequest) Validate() error {
 	if r.UserID == "" {
 		return errors.New("user_id is required!")
 	}
-	if r.Name == nil && r.Enabled == nil && r.Longitude == nil && r.Latitude == nil && r.Radius == nil {
+	if r.Name == nil && r.Enabled == nil && r.Longitude == nil && r.Latitude == nil && r.Radius == nil && r.PlaceID == nil {
 		return errors.New("at least one field must be provided")
 	}
 
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every new reading is checked against the user's enabled fences that are
+// active at the time it was taken: untimed fences always, timed ones between
+// starts_at and ends_at. FenceStates remembers which side of each fence the
+// user is on, and a Geofence_Enter or Geofence_Exit event is written when
+// that changes.
+//
+// GPS fixes wander, so a crossing only counts once the position is clearly
+// past the edge (by the hysteresis margin, at most half the radius) for
+// several readings in a row. The first reading after a fence becomes active,
+// or after it is moved or resized, only records the side the user is on.
+// Fixes less accurate than FENCE_MAX_ACCURACY_METERS are not used at all.
+//
+// Env vars:
+//   GEOFENCE_HYSTERESIS_METERS — margin either side of the edge (default 20)
+//   GEOFENCE_CONFIRM_READINGS  — consecutive readings needed to cross (default 2)
+//   FENCE_MAX_ACCURACY_METERS  — worst fix accuracy fences accept (default 100)
+
+const earthRadiusMeters = 6371000.0
+
+func geofenceHysteresis() float64 {
+	if v := os.Getenv("GEOFENCE_HYSTERESIS_METERS"); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return 20
+}
+
+func geofenceConfirmReadings() int {
+	if v := os.Getenv("GEOFENCE_CONFIRM_READINGS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 2
+}
+
+// fenceState is a FenceStates row. The fence geometry it was computed for is
+// kept so a moved fence starts over.
+type fenceState struct {
+	Inside         bool
+	Pending        int
+	LastRecordedAt time.Time
+	Longitude      float64
+	Latitude       float64
+	Radius         float32
+}
+
+// distanceMeters is the great-circle distance between two points.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// fenceActive reports whether f is watched at t.
+func fenceActive(f Fence, t time.Time) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.StartsAt != nil && t.Before(*f.StartsAt) {
+		return false
+	}
+	if f.EndsAt != nil && !t.Before(*f.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// evaluateFences updates the user's fence states for a newly stored reading
+// and writes an event for every confirmed crossing. It runs in the ingest
+// transaction; the fences are locked so concurrent uploads take turns.
+func evaluateFences(ctx context.Context, tx pgx.Tx, userID string, deviceID *int, statID int, r StatusRequest) error {
+	if r.Accuracy != nil && *r.Accuracy > fenceMaxAccuracy() {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT f.id, f.user_id, f.name, f.enabled, f.longitude, f.latitude, f.radius, f.starts_at, f.ends_at,
+		       f.timed_title, f.place_id, f.created_at,
+		       s.inside, s.pending, s.last_recorded_at, s.longitude, s.latitude, s.radius
+		FROM Fences f
+		LEFT JOIN FenceStates s ON s.fence_id = f.id
+		WHERE f.user_id = $1
+		ORDER BY f.id
+		FOR UPDATE OF f
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	type fenceWithState struct {
+		fence Fence
+		state *fenceState
+	}
+	var fences []fenceWithState
+	for rows.Next() {
+		var f Fence
+		var inside *bool
+		var pending *int
+		var last *time.Time
+		var lon, lat *float64
+		var radius *float32
+		if err := rows.Scan(&f.FenceID, &f.UserID, &f.Name, &f.Enabled, &f.Longitude, &f.Latitude, &f.Radius,
+			&f.StartsAt, &f.EndsAt, &f.TimedTitle, &f.PlaceID, &f.CreatedAt,
+			&inside, &pending, &last, &lon, &lat, &radius); err != nil {
+			rows.Close()
+			return err
+		}
+		entry := fenceWithState{fence: f}
+		if inside != nil {
+			entry.state = &fenceState{
+				Inside: *inside, Pending: *pending, LastRecordedAt: *last,
+				Longitude: *lon, Latitude: *lat, Radius: *radius,
+			}
+		}
+		fences = append(fences, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	at := r.recordedAt
+	for _, entry := range fences {
+		f, state := entry.fence, entry.state
+
+		if !fenceActive(f, at) {
+			// A late reading from outside the window says nothing about now;
+			// otherwise the window has closed and the next one starts afresh
+			if state != nil && at.After(state.LastRecordedAt) {
+				if _, err := tx.Exec(ctx, `DELETE FROM FenceStates WHERE fence_id = $1`, f.FenceID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// Readings from a backlog older than what was already evaluated can't
+		// change the current side
+		if state != nil && !at.After(state.LastRecordedAt) {
+			continue
+		}
+
+		distance := distanceMeters(r.Latitude, r.Longitude, f.Latitude, f.Longitude)
+		radius := float64(f.Radius)
+		margin := math.Min(geofenceHysteresis(), radius/2)
+
+		next := fenceState{LastRecordedAt: at, Longitude: f.Longitude, Latitude: f.Latitude, Radius: f.Radius}
+		crossed := false
+		if state == nil || state.Longitude != f.Longitude || state.Latitude != f.Latitude || state.Radius != f.Radius {
+			next.Inside = distance <= radius
+		} else {
+			next.Inside = state.Inside
+			beyond := (state.Inside && distance > radius+margin) || (!state.Inside && distance < radius-margin)
+			if beyond {
+				next.Pending = state.Pending + 1
+			}
+			if next.Pending >= geofenceConfirmReadings() {
+				next.Inside, next.Pending, crossed = !state.Inside, 0, true
+			}
+		}
+
+		_, err := tx.Exec(ctx, `
+			INSERT INTO FenceStates (fence_id, user_id, inside, pending, last_recorded_at, longitude, latitude, radius, changed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $5)
+			ON CONFLICT (fence_id) DO UPDATE SET
+				inside = EXCLUDED.inside,
+				pending = EXCLUDED.pending,
+				last_recorded_at = EXCLUDED.last_recorded_at,
+				longitude = EXCLUDED.longitude,
+				latitude = EXCLUDED.latitude,
+				radius = EXCLUDED.radius,
+				changed_at = CASE WHEN FenceStates.inside = EXCLUDED.inside THEN FenceStates.changed_at ELSE EXCLUDED.changed_at END
+		`, f.FenceID, userID, next.Inside, next.Pending, at, f.Longitude, f.Latitude, f.Radius)
+		if err != nil {
+			return err
+		}
+
+		if crossed {
+			if _, err := insertEvent(ctx, tx, fenceEvent(f, next.Inside, distance, deviceID, statID, r)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fenceEvent(f Fence, inside bool, distance float64, deviceID *int, statID int, r StatusRequest) Event {
+	eventType, description := "Geofence_Exit", "Left "+f.Name
+	if inside {
+		eventType, description = "Geofence_Enter", "Entered "+f.Name
+	}
+	if f.TimedTitle != "" {
+		description += " during " + f.TimedTitle
+	}
+	details := map[string]any{
+		"fence_id":        f.FenceID,
+		"stat_id":         statID,
+		"longitude":       r.Longitude,
+		"latitude":        r.Latitude,
+		"distance_meters": math.Round(distance),
+		"radius":          f.Radius,
+	}
+	if f.PlaceID != nil {
+		details["place_id"] = *f.PlaceID
+	}
+	if r.Accuracy != nil {
+		details["accuracy"] = *r.Accuracy
+	}
+	return Event{
+		UserID:      f.UserID,
+		Type:        eventType,
+		Name:        f.Name,
+		Description: description,
+		DeviceID:    deviceID,
+		CreatedAt:   r.recordedAt,
+		Details:     details,
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
 )
 
 type GuardianRequest struct {
 	CaneUserID      string `json:"cane_user_id"`
 	CaregiverUserID string `json:"caregiver_user_id"`
+	InviteCode      string `json:"invite_code"`
 }
 
 type DeleteGuardianRequest struct {
@@ -46,22 +48,88 @@ func createGuardian(c echo.Context) error {
 			"error": "cane_user_id and caregiver_user_id are required",
 		})
 	}
+	if !isUUID(req.CaneUserID) || !isUUID(req.CaregiverUserID) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "cane_user_id and caregiver_user_id must be valid user ids",
+		})
+	}
+
+	// A cane user may grant access directly; a caregiver needs an invite the
+	// cane user sent to their email address.
+	ctx := c.Request().Context()
+	caller := currentUser(c)
+	switch {
+	case caller.Type == "Cane_User" && sameUser(caller.UserID, req.CaneUserID):
+	case caller.Type == "Caregiver" && sameUser(caller.UserID, req.CaregiverUserID):
+		if req.InviteCode == "" {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "invite_code is required",
+			})
+		}
+		// Invites are matched by email, so the address has to be confirmed
+		if !caller.EmailVerified {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Verify your email address before accepting an invite",
+			})
+		}
+	default:
+		return accessError(c, errForbidden)
+	}
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create guardian relationship",
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	if req.InviteCode != "" {
+		// The invite is consumed by the link it authorizes
+		cmdTag, err := tx.Exec(ctx, `
+			DELETE FROM Invites
+			WHERE code = $1 AND user_id = $2 AND lower(email) = lower($3) AND expires_at > now()
+		`, req.InviteCode, req.CaneUserID, caller.Email)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to verify invite",
+			})
+		}
+		if cmdTag.RowsAffected() == 0 {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Invite is invalid or expired",
+			})
+		}
+	}
 
 	query := `
 		INSERT INTO guardians (cane_user_id, caregiver_user_id)
-		VALUES ($1, $2)
+		SELECT cane.user_id, caregiver.user_id
+		FROM Users cane, Users caregiver
+		WHERE cane.user_id = $1 AND cane.type = 'Cane_User'
+		  AND caregiver.user_id = $2 AND caregiver.type = 'Caregiver'
 		RETURNING id, cane_user_id, caregiver_user_id, created_at
 	`
 
 	var guardian GuardianResponse
-	err := DB.QueryRow(context.Background(), query, req.CaneUserID, req.CaregiverUserID).Scan(
+	err = tx.QueryRow(ctx, query, req.CaneUserID, req.CaregiverUserID).Scan(
 		&guardian.ID,
 		&guardian.CaneUserID,
 		&guardian.CaregiverUserID,
 		&guardian.CreatedAt,
 	)
 
-	if err != nil {
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "cane_user_id must be a Cane_User and caregiver_user_id a Caregiver",
+		})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create guardian relationship",
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to create guardian relationship",
 		})
@@ -82,8 +150,8 @@ func deleteGuardian(c echo.Context) error {
 		})
 	}
 
-	query := `DELETE FROM guardians WHERE id = $1`
-	cmdTag, err := DB.Exec(context.Background(), query, req.ID)
+	query := `DELETE FROM guardians WHERE id = $1 AND (cane_user_id = $2 OR caregiver_user_id = $2)`
+	cmdTag, err := DB.Exec(context.Background(), query, req.ID, currentUser(c).UserID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to delete guardian relationship",
@@ -106,12 +174,13 @@ func getCaregivers(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	if req.CaneUserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "cane_user_id is required"})
+	caneUserID, err := targetUserID(c, req.CaneUserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `SELECT caregiver_user_id FROM guardians WHERE cane_user_id = $1`
-	rows, err := DB.Query(context.Background(), query, req.CaneUserID)
+	rows, err := DB.Query(context.Background(), query, caneUserID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve caregivers"})
 	}
@@ -140,12 +209,13 @@ func getCaneUsers(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 	}
 
-	if req.CaregiverUserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "caregiver_user_id is required"})
+	caregiverUserID, err := targetUserID(c, req.CaregiverUserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `SELECT cane_user_id FROM guardians WHERE caregiver_user_id = $1`
-	rows, err := DB.Query(context.Background(), query, req.CaregiverUserID)
+	rows, err := DB.Query(context.Background(), query, caregiverUserID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve cane users"})
 	}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Heart-rate rules are checked on every reading that carries a heart rate.
+// Each rule needs the whole of the last sustained_minutes to be out of bounds
+// before it fires, so single noisy readings are ignored:
+//
+//   low     — at or below low_bpm
+//   high    — at or above high_bpm
+//   resting — at or above resting_max_bpm while the user stays in one spot;
+//             a raised heart rate while walking is expected
+//
+// A rule raises one Heart_Rate_Alert per episode, carrying the readings that
+// triggered it, and can fire again once a reading is back in bounds.
+//
+// Readings the cane flags with skin_contact false are stored as sent but
+// left out: they neither count towards a rule nor end an episode. A cane
+// that doesn't send the flag has every reading checked, however low.
+
+const (
+	heartRateRuleLow     = "low"
+	heartRateRuleHigh    = "high"
+	heartRateRuleResting = "resting"
+
+	heartRateMaxGap          = 2 * time.Minute // longest gap between readings that still counts as sustained
+	heartRateMinReadings     = 3
+	heartRateStationaryRange = 50.0 // meters
+	heartRateRecoveryMargin  = 5    // bpm back inside a bound that ends an episode
+)
+
+var defaultHeartRateRules = HeartRateRules{
+	Enabled:          true,
+	LowBPM:           40,
+	RestingMaxBPM:    130,
+	HighBPM:          170,
+	SustainedMinutes: 5,
+}
+
+type HeartRateRules struct {
+	UserID           string     `json:"user_id"`
+	Enabled          bool       `json:"enabled"`
+	LowBPM           int        `json:"low_bpm"`
+	RestingMaxBPM    int        `json:"resting_max_bpm"`
+	HighBPM          int        `json:"high_bpm"`
+	SustainedMinutes int        `json:"sustained_minutes"`
+	UpdatedAt        *time.Time `json:"updated_at"`
+}
+
+type UpdateHeartRateRulesRequest struct {
+	UserID           string `json:"user_id"`
+	Enabled          *bool  `json:"enabled"`
+	LowBPM           *int   `json:"low_bpm"`
+	RestingMaxBPM    *int   `json:"resting_max_bpm"`
+	HighBPM          *int   `json:"high_bpm"`
+	SustainedMinutes *int   `json:"sustained_minutes"`
+}
+
+type heartRateReading struct {
+	StatID     int       `json:"stat_id"`
+	HeartRate  int       `json:"heart_rate"`
+	Longitude  float64   `json:"longitude"`
+	Latitude   float64   `json:"latitude"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// loadHeartRateRules returns the user's rules, or the defaults if they have
+// not changed them.
+func loadHeartRateRules(ctx context.Context, db dbtx, userID string) (HeartRateRules, error) {
+	rules := defaultHeartRateRules
+	rules.UserID = userID
+	err := db.QueryRow(ctx, `
+		SELECT enabled, low_bpm, resting_max_bpm, high_bpm, sustained_minutes, updated_at
+		FROM HeartRateRules WHERE user_id = $1
+	`, userID).Scan(&rules.Enabled, &rules.LowBPM, &rules.RestingMaxBPM, &rules.HighBPM, &rules.SustainedMinutes, &rules.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return rules, nil
+	}
+	return rules, err
+}
+
+func getHeartRateRules(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	rules, err := loadHeartRateRules(c.Request().Context(), DB, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch heart rate rules"})
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+func updateHeartRateRules(c echo.Context) error {
+	var req UpdateHeartRateRulesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	if req.Enabled == nil && req.LowBPM == nil && req.RestingMaxBPM == nil && req.HighBPM == nil && req.SustainedMinutes == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "at least one field must be provided"})
+	}
+
+	ctx := c.Request().Context()
+	rules, err := loadHeartRateRules(ctx, DB, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch heart rate rules"})
+	}
+
+	if req.Enabled != nil {
+		rules.Enabled = *req.Enabled
+	}
+	if req.LowBPM != nil {
+		rules.LowBPM = *req.LowBPM
+	}
+	if req.RestingMaxBPM != nil {
+		rules.RestingMaxBPM = *req.RestingMaxBPM
+	}
+	if req.HighBPM != nil {
+		rules.HighBPM = *req.HighBPM
+	}
+	if req.SustainedMinutes != nil {
+		rules.SustainedMinutes = *req.SustainedMinutes
+	}
+	if err := rules.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	err = DB.QueryRow(ctx, `
+		INSERT INTO HeartRateRules (user_id, enabled, low_bpm, resting_max_bpm, high_bpm, sustained_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			low_bpm = EXCLUDED.low_bpm,
+			resting_max_bpm = EXCLUDED.resting_max_bpm,
+			high_bpm = EXCLUDED.high_bpm,
+			sustained_minutes = EXCLUDED.sustained_minutes,
+			updated_at = now()
+		RETURNING updated_at
+	`, userID, rules.Enabled, rules.LowBPM, rules.RestingMaxBPM, rules.HighBPM, rules.SustainedMinutes).Scan(&rules.UpdatedAt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update heart rate rules"})
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+func (r *HeartRateRules) Validate() error {
+	if r.LowBPM < 20 || r.HighBPM > 250 {
+		return errors.New("bounds must be between 20 and 250 bpm")
+	}
+	if r.LowBPM >= r.RestingMaxBPM || r.RestingMaxBPM >= r.HighBPM {
+		return errors.New("bounds must satisfy low_bpm < resting_max_bpm < high_bpm")
+	}
+	if r.SustainedMinutes < 1 || r.SustainedMinutes > 60 {
+		return errors.New("sustained_minutes must be between 1 and 60")
+	}
+	return nil
+}
+
+// heartRateRuleHolds reports whether readings, oldest first, show the rule
+// broken for the whole window ending at `at`.
+func heartRateRuleHolds(rule string, rules HeartRateRules, readings []heartRateReading, at time.Time) bool {
+	window := time.Duration(rules.SustainedMinutes) * time.Minute
+	if len(readings) < heartRateMinReadings || readings[0].RecordedAt.After(at.Add(-window).Add(heartRateMaxGap)) {
+		return false
+	}
+	for i, r := range readings {
+		if i > 0 && r.RecordedAt.Sub(readings[i-1].RecordedAt) > heartRateMaxGap {
+			return false
+		}
+		switch rule {
+		case heartRateRuleLow:
+			if r.HeartRate > rules.LowBPM {
+				return false
+			}
+		case heartRateRuleHigh:
+			if r.HeartRate < rules.HighBPM {
+				return false
+			}
+		case heartRateRuleResting:
+			if r.HeartRate < rules.RestingMaxBPM ||
+				distanceMeters(readings[0].Latitude, readings[0].Longitude, r.Latitude, r.Longitude) > heartRateStationaryRange {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// heartRateRecovered reports whether a reading ends an episode of rule.
+func heartRateRecovered(rule string, rules HeartRateRules, bpm int) bool {
+	switch rule {
+	case heartRateRuleLow:
+		return bpm > rules.LowBPM+heartRateRecoveryMargin
+	case heartRateRuleHigh:
+		return bpm < rules.HighBPM-heartRateRecoveryMargin
+	default:
+		return bpm < rules.RestingMaxBPM-heartRateRecoveryMargin
+	}
+}
+
+// checkHeartRate runs the user's heart-rate rules against a new reading and
+// raises a Heart_Rate_Alert for each rule that starts an episode.
+func checkHeartRate(ctx context.Context, tx pgx.Tx, userID string, deviceID *int, r StatusRequest) error {
+	if r.HeartRate == nil || (r.SkinContact != nil && !*r.SkinContact) {
+		return nil
+	}
+
+	var active []string
+	var lastRecordedAt *time.Time
+	err := tx.QueryRow(ctx, `
+		SELECT active_rules, last_recorded_at FROM HeartRateStates WHERE user_id = $1 FOR UPDATE
+	`, userID).Scan(&active, &lastRecordedAt)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if lastRecordedAt != nil && !r.recordedAt.After(*lastRecordedAt) {
+		return nil
+	}
+
+	rules, err := loadHeartRateRules(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if !rules.Enabled {
+		active = nil
+	}
+
+	// An episode ends once the heart rate is back in bounds
+	active = slices.DeleteFunc(active, func(rule string) bool {
+		return heartRateRecovered(rule, rules, *r.HeartRate)
+	})
+	if active == nil {
+		active = []string{}
+	}
+
+	if rules.Enabled {
+		window := time.Duration(rules.SustainedMinutes) * time.Minute
+		rows, err := tx.Query(ctx, `
+			SELECT id, heart_rate, longitude, latitude, created_at FROM Stats
+			WHERE user_id = $1 AND heart_rate IS NOT NULL AND skin_contact IS NOT FALSE
+			  AND created_at >= $2 AND created_at <= $3
+			ORDER BY created_at
+		`, userID, r.recordedAt.Add(-window), r.recordedAt)
+		if err != nil {
+			return err
+		}
+		readings, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (heartRateReading, error) {
+			var hr heartRateReading
+			err := row.Scan(&hr.StatID, &hr.HeartRate, &hr.Longitude, &hr.Latitude, &hr.RecordedAt)
+			return hr, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range []string{heartRateRuleLow, heartRateRuleHigh, heartRateRuleResting} {
+			if slices.Contains(active, rule) || !heartRateRuleHolds(rule, rules, readings, r.recordedAt) {
+				continue
+			}
+			active = append(active, rule)
+			if _, err := insertEvent(ctx, tx, heartRateEvent(userID, deviceID, rule, rules, readings, r.recordedAt)); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO HeartRateStates (user_id, active_rules, last_recorded_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			active_rules = EXCLUDED.active_rules,
+			last_recorded_at = EXCLUDED.last_recorded_at
+	`, userID, active, r.recordedAt)
+	return err
+}
+
+func heartRateEvent(userID string, deviceID *int, rule string, rules HeartRateRules, readings []heartRateReading, at time.Time) Event {
+	low, high, sum := readings[0].HeartRate, readings[0].HeartRate, 0
+	for _, r := range readings {
+		low, high, sum = min(low, r.HeartRate), max(high, r.HeartRate), sum+r.HeartRate
+	}
+
+	var name string
+	var bound int
+	switch rule {
+	case heartRateRuleLow:
+		name, bound = "Low heart rate", rules.LowBPM
+	case heartRateRuleHigh:
+		name, bound = "High heart rate", rules.HighBPM
+	default:
+		name, bound = "High resting heart rate", rules.RestingMaxBPM
+	}
+	description := fmt.Sprintf("Heart rate %d-%d bpm for %d min", low, high, rules.SustainedMinutes)
+	if rule == heartRateRuleResting {
+		description += " while stationary"
+	}
+
+	return Event{
+		UserID:      userID,
+		Type:        "Heart_Rate_Alert",
+		Name:        name,
+		Description: description,
+		DeviceID:    deviceID,
+		CreatedAt:   at,
+		Details: map[string]any{
+			"rule":              rule,
+			"bound_bpm":         bound,
+			"sustained_minutes": rules.SustainedMinutes,
+			"min_bpm":           low,
+			"max_bpm":           high,
+			"avg_bpm":           math.Round(float64(sum) / float64(len(readings))),
+			"readings":          readings,
+		},
+	}
+}
@@ -43,6 +43,16 @@ func createInvite(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
 	}
 
+	// An invite grants access to the sender's data, so only the cane user
+	// can send one; a caregiver could otherwise invite anyone in.
+	userID, err := selfUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	if currentUser(c).Type != "Cane_User" {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Only cane users can send invites"})
+	}
+
 	inviteCode, err := generateInviteCode(16)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate invite code"})
@@ -57,7 +67,7 @@ func createInvite(c echo.Context) error {
 	`
 
 	var newInvite Invite
-	err = DB.QueryRow(context.Background(), sql, inviteCode, req.UserID, req.Email, expiresAt).Scan(
+	err = DB.QueryRow(context.Background(), sql, inviteCode, userID, req.Email, expiresAt).Scan(
 		&newInvite.ID,
 		&newInvite.Code,
 		&newInvite.UserID,
@@ -115,9 +125,9 @@ func deleteInvite(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invite code is required"})
 	}
 
-	sql := `DELETE FROM Invites WHERE code = $1`
+	sql := `DELETE FROM Invites WHERE code = $1 AND user_id = $2`
 
-	cmdTag, err := DB.Exec(context.Background(), sql, req.Code)
+	cmdTag, err := DB.Exec(context.Background(), sql, req.Code, currentUser(c).UserID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete invite"})
 	}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Timestamps in responses are UTC unless the request asks otherwise with the
+// tz query parameter: an IANA name such as America/Toronto, or "local" for
+// the caller's preferred timezone. Unknown names are ignored.
+
+type localTimeSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s localTimeSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	if loc := responseLocation(c); loc != nil {
+		i = timesIn(i, loc)
+	}
+	return s.DefaultJSONSerializer.Serialize(c, i, indent)
+}
+
+// responseLocation returns the timezone requested for the response, or nil.
+func responseLocation(c echo.Context) *time.Location {
+	tz := c.QueryParam("tz")
+	switch tz {
+	case "", "Local":
+		return nil
+	case "local":
+		var userID string
+		if user := currentUser(c); user != nil {
+			userID = user.UserID
+		} else if device := currentDevice(c); device != nil {
+			userID = device.UserID
+		} else {
+			return nil
+		}
+		prefs, err := loadPreferences(c.Request().Context(), DB, userID)
+		if err != nil {
+			return nil
+		}
+		return prefs.location()
+	default:
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil
+		}
+		return loc
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timesIn returns v with every time.Time reachable from it moved to loc.
+// Values reached through pointers, slices and maps are converted in place;
+// responses are built per request, so nothing shared is affected.
+func timesIn(v interface{}, loc *time.Location) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return v
+	}
+	cp := reflect.New(rv.Type()).Elem()
+	cp.Set(rv)
+	convertTimes(cp, loc)
+	return cp.Interface()
+}
+
+func convertTimes(v reflect.Value, loc *time.Location) {
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == timeType {
+			if v.CanSet() {
+				v.Set(reflect.ValueOf(v.Interface().(time.Time).In(loc)))
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				convertTimes(v.Field(i), loc)
+			}
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			convertTimes(v.Elem(), loc)
+		}
+	case reflect.Interface:
+		if !v.IsNil() && v.CanSet() {
+			elem := v.Elem()
+			cp := reflect.New(elem.Type()).Elem()
+			cp.Set(elem)
+			convertTimes(cp, loc)
+			v.Set(cp)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			convertTimes(v.Index(i), loc)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := iter.Value()
+			cp := reflect.New(elem.Type()).Elem()
+			cp.Set(elem)
+			convertTimes(cp, loc)
+			v.SetMapIndex(iter.Key(), cp)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+// ─── Outgoing email ──────────────────────────────────────────────────────────
+//
+// Env vars:
+//   MAILER         — "smtp" or "log"                         (default log)
+//   MAIL_FROM      — sender address                          (default no-reply@senseway.ca)
+//   MAIL_LOG_PATH  — file the log mailer appends to; empty logs to stderr
+//   SMTP_HOST, SMTP_PORT (default 587), SMTP_USERNAME, SMTP_PASSWORD
+//   APP_URL        — base URL used in links inside emails    (default https://senseway.ca)
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var mailer Mailer = &LogMailer{}
+
+// newMailer builds the Mailer selected by the MAILER env var.
+func newMailer() Mailer {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     mailFrom(),
+		}
+	default:
+		return &LogMailer{Path: os.Getenv("MAIL_LOG_PATH")}
+	}
+}
+
+func mailFrom() string {
+	if v := os.Getenv("MAIL_FROM"); v != "" {
+		return v
+	}
+	return "no-reply@senseway.ca"
+}
+
+func appURL() string {
+	if v := os.Getenv("APP_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "https://senseway.ca"
+}
+
+// sendMail delivers msg in the background so request latency does not reveal
+// whether an address exists, and a slow mail server does not hold up the API.
+func sendMail(msg Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("[mail] sending %q to %s failed: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// ─── SMTP ────────────────────────────────────────────────────────────────────
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers msg over one connection, dialled with ctx and bound to its
+// deadline, so an unreachable or stalled server gives up instead of leaving
+// the send running. It upgrades to TLS and authenticates like smtp.SendMail.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(m.Host, m.Port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatMessage(m.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// ─── Log / file ──────────────────────────────────────────────────────────────
+
+// LogMailer writes messages to a file, or the log when Path is empty, instead
+// of delivering them. Used for local development and tests.
+type LogMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	entry := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	if m.Path == "" {
+		log.Printf("[mail] %s", entry)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "--- %s\n%s\n", time.Now().Format(time.RFC3339), entry)
+	return err
+}
@@ -3,21 +3,35 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 func main() {
+	// Stored tokens and device keys are hashed with it; see tokens.go
+	if os.Getenv("SESSION_SECRET") == "" {
+		log.Fatal("SESSION_SECRET must be set")
+	}
+
 	if err := ConnectDB(); err != nil {
 		log.Fatalf("Could not connect to the database: %v", err)
 	}
 	defer DB.Close()
 
+	mailer = newMailer()
+	storage = newStorage()
+
 	go hubRun()    // manages WebSocket client list + frame broadcast
 	go StartStream() // pulls Pi UDP stream via FFmpeg, pushes JPEG frames
+	go runWatchdog()  // marks canes offline when their status uploads stop
+	go runDailySummaries() // stores activity summaries of finished days
+	go runSegmentBackfill() // segments location history from before a user's segmentation started
 
 	e := echo.New()
+	e.JSONSerializer = localTimeSerializer{} // ?tz= renders timestamps in a chosen timezone
+	e.IPExtractor = clientIPExtractor()      // forwarded headers only from TRUSTED_PROXIES
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
@@ -28,6 +42,9 @@ func main() {
 		AllowCredentials: true,
 	}))
 
+	// Every route below needs a pathpal_session cookie unless listed in publicRoutes
+	e.Use(requireAuth)
+
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "PathPal API is running!")
 	})
@@ -37,8 +54,21 @@ func main() {
 	// Auth Routes
 	e.POST("/register", registerUser)
 	e.POST("/login", loginUser)
+	e.POST("/login/2fa", loginTwoFactor)
 	e.GET("/session", getSession)
 	e.DELETE("/session", logoutUser)
+	e.GET("/sessions", listSessions)
+	e.PUT("/sessions", renameSession)
+	e.DELETE("/sessions", revokeSession)
+	e.DELETE("/sessions/others", revokeOtherSessions)
+	e.POST("/password/reset", requestPasswordReset)
+	e.POST("/password/reset/confirm", confirmPasswordReset)
+	e.POST("/email/verify", verifyEmail)
+	e.POST("/email/verify/resend", resendVerificationEmail)
+	e.POST("/2fa/setup", setupTwoFactor)
+	e.POST("/2fa/confirm", confirmTwoFactor)
+	e.POST("/2fa/recovery-codes", regenerateRecoveryCodes)
+	e.DELETE("/2fa", disableTwoFactor)
 
 	// Events Routes
 	e.POST("/events", createEvent)
@@ -59,16 +89,46 @@ func main() {
 	//User Routes
 	e.GET("/user", getUser)
 	e.PUT("/user", putUser)
+	e.PATCH("/user", putUser)
 	e.DELETE("/user", deleteUser)
+	e.POST("/user/avatar", uploadAvatar)
+	e.DELETE("/user/avatar", deleteAvatar)
+
+	// Uploaded files, when kept on local disk
+	if local, ok := storage.(*LocalStorage); ok {
+		e.Static(localStorageRoute, local.Dir)
+	}
+
+	// Preference Routes
+	e.GET("/preferences", getPreferences)
+	e.PATCH("/preferences", updatePreferences)
+
+	// Medical Profile Routes
+	e.GET("/medical", getMedicalProfile)
+	e.PUT("/medical", updateMedicalProfile)
 
 	// Stats Routes
 	e.GET("/location", getLocation)
 	e.GET("/locationByTime", getLocationByTime)
+	e.GET("/location/export", exportLocations)
+	e.GET("/timeline", getTimeline)
+	e.GET("/activity/daily", getDailySummaries)
 	e.GET("/battery", getBattery)
+	e.GET("/battery/aggregate", getBatteryAggregate)
 	e.GET("/heartRate", getHeartRate)
 	e.GET("/heartRateByTime", getHeartRateByTime)
+	e.GET("/heartRate/aggregate", getHeartRateAggregate)
+	e.GET("/heartRate/rules", getHeartRateRules)
+	e.PATCH("/heartRate/rules", updateHeartRateRules)
 	e.GET("/status", getStatus)
 	e.POST("/status", postStatus)
+	e.POST("/status/batch", postStatusBatch)
+
+	// Place Routes
+	e.GET("/places", listPlaces)
+	e.POST("/places", createPlace)
+	e.PUT("/places", updatePlace)
+	e.DELETE("/places", deletePlace)
 
 	// Appointment Routes
 	e.GET("/appointments", listAppointments)
@@ -76,12 +136,30 @@ func main() {
 	e.PUT("/appointments", updateAppointment)
 	e.DELETE("/appointments", deleteAppointment)
 
+	// Device Routes
+	e.POST("/devices", createDevice)
+	e.GET("/devices", listDevices)
+	e.POST("/devices/rotate", rotateDevice)
+	e.DELETE("/devices", revokeDevice)
+
 	// Guardian Routes
 	e.POST("/guardians", createGuardian)
 	e.DELETE("/guardians", deleteGuardian)
 	e.GET("/caregivers", getCaregivers)
 	e.GET("/caneusers", getCaneUsers)
 
+	// Admin Routes
+	admin := e.Group("/admin", requireAdmin)
+	admin.GET("/users", adminSearchUsers)
+	admin.GET("/users/:user_id", adminGetUser)
+	admin.DELETE("/users/:user_id/sessions", adminForceLogout)
+	admin.POST("/users/:user_id/disable", adminDisableUser)
+	admin.POST("/users/:user_id/enable", adminEnableUser)
+	admin.PUT("/users/:user_id/role", adminSetRole)
+	admin.POST("/guardians", adminLinkGuardian)
+	admin.DELETE("/guardians", adminUnlinkGuardian)
+	admin.GET("/audit", adminListAudit)
+
 	// Camera Stream Routes
 	e.GET("/ws/stream", streamWSHandler)       // WebSocket — clients subscribe here
 	e.GET("/stream/status", streamStatusHandler) // REST — check if Pi is live
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// A cane user's emergency medical profile. It can be edited by the cane user
+// and their guardians, and is attached to SOS and Fall events so whoever
+// responds has it at hand.
+
+const maxEmergencyContacts = 10
+
+var bloodTypes = map[string]bool{
+	"A+": true, "A-": true, "B+": true, "B-": true,
+	"AB+": true, "AB-": true, "O+": true, "O-": true,
+}
+
+// emergencyEventTypes carry the medical profile in event payloads.
+var emergencyEventTypes = map[string]bool{
+	"SOS":  true,
+	"Fall": true,
+}
+
+type EmergencyContact struct {
+	Name         string `json:"name"`
+	Relationship string `json:"relationship"`
+	Phone        string `json:"phone"`
+}
+
+type MedicalProfile struct {
+	UserID            string             `json:"user_id"`
+	Conditions        []string           `json:"conditions"`
+	Medications       []string           `json:"medications"`
+	Allergies         []string           `json:"allergies"`
+	BloodType         string             `json:"blood_type"`
+	PreferredHospital string             `json:"preferred_hospital"`
+	EmergencyContacts []EmergencyContact `json:"emergency_contacts"`
+	Notes             string             `json:"notes"`
+	UpdatedAt         *time.Time         `json:"updated_at"`
+}
+
+type UpdateMedicalProfileRequest struct {
+	UserID            string              `json:"user_id"`
+	Conditions        *[]string           `json:"conditions"`
+	Medications       *[]string           `json:"medications"`
+	Allergies         *[]string           `json:"allergies"`
+	BloodType         *string             `json:"blood_type"`
+	PreferredHospital *string             `json:"preferred_hospital"`
+	EmergencyContacts *[]EmergencyContact `json:"emergency_contacts"`
+	Notes             *string             `json:"notes"`
+}
+
+var errNotCaneUser = errors.New("medical profiles are only kept for cane users")
+
+// loadMedicalProfile returns the profile of a cane user, empty if they have
+// not filled it in yet, or errNotCaneUser.
+func loadMedicalProfile(ctx context.Context, userID string) (MedicalProfile, error) {
+	var p MedicalProfile
+	err := DB.QueryRow(ctx, `
+		SELECT u.user_id,
+		       COALESCE(m.conditions, '{}'), COALESCE(m.medications, '{}'), COALESCE(m.allergies, '{}'),
+		       COALESCE(m.blood_type, ''), COALESCE(m.preferred_hospital, ''),
+		       COALESCE(m.emergency_contacts, '[]'), COALESCE(m.notes, ''), m.updated_at
+		FROM Users u
+		LEFT JOIN MedicalProfiles m ON m.user_id = u.user_id
+		WHERE u.user_id = $1 AND u.type = 'Cane_User'
+	`, userID).Scan(
+		&p.UserID, &p.Conditions, &p.Medications, &p.Allergies,
+		&p.BloodType, &p.PreferredHospital, &p.EmergencyContacts, &p.Notes, &p.UpdatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return p, errNotCaneUser
+	}
+	return p, err
+}
+
+func getMedicalProfile(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	profile, err := loadMedicalProfile(c.Request().Context(), userID)
+	if err == errNotCaneUser {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch medical profile"})
+	}
+	return c.JSON(http.StatusOK, profile)
+}
+
+func updateMedicalProfile(c echo.Context) error {
+	var req UpdateMedicalProfileRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	current, err := loadMedicalProfile(ctx, userID)
+	if err == errNotCaneUser {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch medical profile"})
+	}
+
+	if req.Conditions != nil {
+		current.Conditions = *req.Conditions
+	}
+	if req.Medications != nil {
+		current.Medications = *req.Medications
+	}
+	if req.Allergies != nil {
+		current.Allergies = *req.Allergies
+	}
+	if req.BloodType != nil {
+		current.BloodType = *req.BloodType
+	}
+	if req.PreferredHospital != nil {
+		current.PreferredHospital = *req.PreferredHospital
+	}
+	if req.EmergencyContacts != nil {
+		current.EmergencyContacts = *req.EmergencyContacts
+	}
+	if req.Notes != nil {
+		current.Notes = *req.Notes
+	}
+
+	sql := `
+		INSERT INTO MedicalProfiles (user_id, conditions, medications, allergies, blood_type,
+		                             preferred_hospital, emergency_contacts, notes, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET
+			conditions = EXCLUDED.conditions,
+			medications = EXCLUDED.medications,
+			allergies = EXCLUDED.allergies,
+			blood_type = EXCLUDED.blood_type,
+			preferred_hospital = EXCLUDED.preferred_hospital,
+			emergency_contacts = EXCLUDED.emergency_contacts,
+			notes = EXCLUDED.notes,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = now()
+		RETURNING updated_at
+	`
+	err = DB.QueryRow(ctx, sql,
+		userID, current.Conditions, current.Medications, current.Allergies, current.BloodType,
+		current.PreferredHospital, current.EmergencyContacts, current.Notes, currentUser(c).UserID,
+	).Scan(&current.UpdatedAt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update medical profile"})
+	}
+
+	return c.JSON(http.StatusOK, current)
+}
+
+func (r *UpdateMedicalProfileRequest) Validate() error {
+	if r.Conditions == nil && r.Medications == nil && r.Allergies == nil && r.BloodType == nil &&
+		r.PreferredHospital == nil && r.EmergencyContacts == nil && r.Notes == nil {
+		return errors.New("at least one field must be provided")
+	}
+
+	for _, list := range []*[]string{r.Conditions, r.Medications, r.Allergies} {
+		if list != nil {
+			*list = cleanList(*list)
+		}
+	}
+	if r.BloodType != nil {
+		bloodType := strings.ToUpper(strings.TrimSpace(*r.BloodType))
+		if bloodType != "" && !bloodTypes[bloodType] {
+			return errors.New("blood_type must be one of A+, A-, B+, B-, AB+, AB-, O+, O- or empty")
+		}
+		*r.BloodType = bloodType
+	}
+	if r.PreferredHospital != nil {
+		*r.PreferredHospital = strings.TrimSpace(*r.PreferredHospital)
+	}
+	if r.Notes != nil {
+		*r.Notes = strings.TrimSpace(*r.Notes)
+	}
+	if r.EmergencyContacts != nil {
+		contacts := *r.EmergencyContacts
+		if contacts == nil {
+			contacts = []EmergencyContact{}
+		}
+		if len(contacts) > maxEmergencyContacts {
+			return errors.New("at most 10 emergency contacts are allowed")
+		}
+		for i := range contacts {
+			contacts[i].Name = strings.TrimSpace(contacts[i].Name)
+			contacts[i].Relationship = strings.TrimSpace(contacts[i].Relationship)
+			contacts[i].Phone = strings.TrimSpace(contacts[i].Phone)
+			if contacts[i].Name == "" {
+				return errors.New("emergency contact name is required")
+			}
+			if !isValidPhone(contacts[i].Phone) {
+				return errors.New("emergency contact phone must be a valid phone number")
+			}
+		}
+		*r.EmergencyContacts = contacts
+	}
+	return nil
+}
+
+// cleanList trims entries and drops empty ones.
+func cleanList(items []string) []string {
+	out := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// isValidPhone accepts digits with the usual separators and an optional
+// leading +, e.g. "+1 (613) 555-0100".
+func isValidPhone(phone string) bool {
+	digits := 0
+	for i, ch := range phone {
+		switch {
+		case ch >= '0' && ch <= '9':
+			digits++
+		case ch == '+' && i == 0:
+		case ch == ' ' || ch == '-' || ch == '(' || ch == ')' || ch == '.':
+		default:
+			return false
+		}
+	}
+	return digits >= 3 && digits <= 15
+}
+
+// attachMedicalProfiles adds the owner's medical profile to SOS and Fall
+// events, loading each profile once.
+func attachMedicalProfiles(ctx context.Context, events []Event) error {
+	profiles := map[string]*MedicalProfile{}
+	for i := range events {
+		if !emergencyEventTypes[events[i].Type] {
+			continue
+		}
+		profile, ok := profiles[events[i].UserID]
+		if !ok {
+			p, err := loadMedicalProfile(ctx, events[i].UserID)
+			if err != nil && err != errNotCaneUser {
+				return err
+			}
+			if err == nil {
+				profile = &p
+			}
+			profiles[events[i].UserID] = profile
+		}
+		events[i].MedicalProfile = profile
+	}
+	return nil
+}
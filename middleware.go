@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	contextUserKey    = "user"
+	contextSessionKey = "session_id"
+	contextDeviceKey  = "device"
+)
+
+// publicRoutes can be reached without a session. Keys are "METHOD path" using
+// the path pattern the route was registered with.
+var publicRoutes = map[string]bool{
+	"GET /":              true,
+	"POST /register":     true,
+	"POST /login":        true,
+	"GET /invites/:code": true,
+	"GET /uploads/*":     true,
+
+	"POST /password/reset":         true,
+	"POST /password/reset/confirm": true,
+	"POST /email/verify":           true,
+	"POST /email/verify/resend":    true,
+	"POST /login/2fa":              true,
+}
+
+// deviceRoutes additionally accept a device API key as a bearer token, so the
+// cane hardware can submit data without a human session.
+var deviceRoutes = map[string]bool{
+	"POST /status":       true,
+	"POST /status/batch": true,
+	"POST /events":       true,
+}
+
+var errForbidden = errors.New("forbidden")
+
+// requireAuth resolves the pathpal_session cookie into the calling user and
+// stores it on the context. Every route that is not in publicRoutes needs a
+// valid session, or a device key on deviceRoutes.
+func requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		route := c.Request().Method + " " + c.Path()
+		if publicRoutes[route] {
+			return next(c)
+		}
+
+		if key, ok := bearerToken(c); ok {
+			if !deviceRoutes[route] {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Device keys are not accepted on this route"})
+			}
+			device, err := findDevice(c.Request().Context(), key)
+			if err == errInvalidDeviceKey {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid device key"})
+			} else if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+			}
+			c.Set(contextDeviceKey, &device)
+			return next(c)
+		}
+
+		cookie, err := c.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "No session cookie"})
+		}
+
+		ctx := c.Request().Context()
+		sessionID, userID, err := findSession(ctx, cookie.Value)
+		if err == errInvalidSession {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid session"})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
+
+		user, err := loadUser(ctx, userID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid session"})
+		}
+		if err := touchSession(ctx, sessionID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
+		if !user.EmailVerified && !unverifiedAllowed(route) {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Email address not verified"})
+		}
+		if !user.TwoFactor && twoFactorRequired(user.Type) && !twoFactorSetupRoutes[route] {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Two-factor authentication is required for this account"})
+		}
+
+		c.Set(contextUserKey, &user)
+		c.Set(contextSessionKey, sessionID)
+		return next(c)
+	}
+}
+
+// currentUser returns the user authenticated by requireAuth.
+func currentUser(c echo.Context) *UserResponse {
+	user, _ := c.Get(contextUserKey).(*UserResponse)
+	return user
+}
+
+// currentDevice returns the device authenticated by requireAuth, or nil for
+// session callers.
+func currentDevice(c echo.Context) *Device {
+	device, _ := c.Get(contextDeviceKey).(*Device)
+	return device
+}
+
+// currentSessionID returns the Sessions row id authenticated by requireAuth.
+func currentSessionID(c echo.Context) int {
+	id, _ := c.Get(contextSessionKey).(int)
+	return id
+}
+
+// targetUserID returns the user a request should read or write. An empty
+// requested id means the caller; any other id must be one the caller may access.
+func targetUserID(c echo.Context, requested string) (string, error) {
+	user := currentUser(c)
+	if user == nil {
+		return "", errForbidden
+	}
+	requested = strings.TrimSpace(requested)
+	if requested == "" || sameUser(requested, user.UserID) {
+		return user.UserID, nil
+	}
+
+	ok, err := canAccessUser(c.Request().Context(), user, requested)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errForbidden
+	}
+	return strings.ToLower(requested), nil
+}
+
+// canAccessUser reports whether caller may read or act on targetID's data. A
+// user always has access to themselves, and a Caregiver to every Cane_User
+// linked to them through Guardians.
+func canAccessUser(ctx context.Context, caller *UserResponse, targetID string) (bool, error) {
+	if sameUser(caller.UserID, targetID) {
+		return true, nil
+	}
+	if caller.Type != "Caregiver" || !isUUID(targetID) {
+		return false, nil
+	}
+	return isGuardianOf(ctx, caller.UserID, targetID)
+}
+
+// isGuardianOf reports whether a Guardians row links the caregiver to the cane user.
+func isGuardianOf(ctx context.Context, caregiverID, caneUserID string) (bool, error) {
+	sql := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM Guardians g
+			JOIN Users u ON u.user_id = g.cane_user_id
+			WHERE g.caregiver_user_id = $1 AND g.cane_user_id = $2 AND u.type = 'Cane_User'
+		)
+	`
+	var linked bool
+	err := DB.QueryRow(ctx, sql, caregiverID, caneUserID).Scan(&linked)
+	return linked, err
+}
+
+// selfUserID is like targetUserID but only ever resolves to the caller. It is
+// used for account-level operations nobody else may perform.
+func selfUserID(c echo.Context, requested string) (string, error) {
+	user := currentUser(c)
+	if user == nil {
+		return "", errForbidden
+	}
+	requested = strings.TrimSpace(requested)
+	if requested == "" || sameUser(requested, user.UserID) {
+		return user.UserID, nil
+	}
+	return "", errForbidden
+}
+
+// accessError writes the response for an error returned by targetUserID.
+func accessError(c echo.Context, err error) error {
+	if errors.Is(err, errForbidden) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Forbidden"})
+	}
+	return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to authorize request"})
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+func sameUser(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// isUUID reports whether s is a canonical hyphenated UUID, so malformed ids are
+// rejected before they reach a UUID column.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
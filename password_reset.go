@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetDuration = time.Hour
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// POST /password/reset - Email a single-use reset link. The response is the
+// same whether or not the address is registered.
+func requestPasswordReset(c echo.Context) error {
+	var req PasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "email is required"})
+	}
+
+	sent := echo.Map{"message": "If that email is registered, a reset link has been sent"}
+
+	ctx := c.Request().Context()
+	var userID, name string
+	err := DB.QueryRow(ctx, `SELECT user_id, name FROM Users WHERE email = $1`, email).Scan(&userID, &name)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusOK, sent)
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate reset token"})
+	}
+
+	// Only the most recent link works
+	_, err = DB.Exec(ctx, `DELETE FROM PasswordResets WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create reset token"})
+	}
+	_, err = DB.Exec(ctx,
+		`INSERT INTO PasswordResets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, hashToken(token), time.Now().Add(passwordResetDuration),
+	)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create reset token"})
+	}
+
+	sendMail(Message{
+		To:      email,
+		Subject: "Reset your PathPal password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password for your PathPal account. "+
+			"Open the link below within the next hour to choose a new one:\n\n%s\n\n"+
+			"If you did not ask for this, you can ignore this email.\n",
+			name, appURL()+"/reset-password?token="+url.QueryEscape(token)),
+	})
+
+	return c.JSON(http.StatusOK, sent)
+}
+
+// POST /password/reset/confirm - Set a new password with a reset token, sign
+// the account out everywhere and lift any sign-in lockout.
+func confirmPasswordReset(c echo.Context) error {
+	var req PasswordResetConfirmRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.Token == "" || req.Password == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "token and password are required"})
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), 12)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to hash password"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, `
+		UPDATE PasswordResets SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id
+	`, hashToken(req.Token)).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Reset token is invalid or expired"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE Users SET password_hash = $1 WHERE user_id = $2`, string(hashedPassword), userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update password"})
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM Sessions WHERE user_id = $1`, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke sessions"})
+	}
+	// A reset also lifts any sign-in lockout on the account
+	_, err = tx.Exec(ctx, `DELETE FROM LoginThrottles WHERE key = 'email:' || (SELECT lower(email) FROM Users WHERE user_id = $1)`, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unlock account"})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Password has been reset"})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Places are a user's saved locations. Every user has exactly one "home"
+// place, kept in step with Users.home_long/home_lat; it can be moved but not
+// deleted. Fences and appointments may reference a place instead of carrying
+// their own coordinates, and fences follow the place when it moves. A fence
+// that took the place's radius also follows a change to it; one created with
+// its own radius keeps it.
+
+const homePlaceCategory = "home"
+
+var placeCategories = map[string]bool{
+	homePlaceCategory: true,
+	"day_program":     true,
+	"work":            true,
+	"school":          true,
+	"medical":         true,
+	"pharmacy":        true,
+	"family":          true,
+	"shopping":        true,
+	"transit":         true,
+	"other":           true,
+}
+
+const placeColumns = `id, user_id, name, category, longitude, latitude, radius, address, created_at, updated_at`
+
+type Place struct {
+	ID        int       `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	Longitude float64   `json:"longitude"`
+	Latitude  float64   `json:"latitude"`
+	Radius    *float32  `json:"radius"`
+	Address   string    `json:"address"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreatePlaceRequest struct {
+	UserID    string   `json:"user_id"`
+	Name      string   `json:"name"`
+	Category  string   `json:"category"`
+	Longitude float64  `json:"longitude"`
+	Latitude  float64  `json:"latitude"`
+	Radius    *float32 `json:"radius"`
+	Address   string   `json:"address"`
+}
+
+type UpdatePlaceRequest struct {
+	ID        int      `json:"id"`
+	UserID    string   `json:"user_id"`
+	Name      *string  `json:"name"`
+	Category  *string  `json:"category"`
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+	Radius    *float32 `json:"radius"`
+	SetRadius bool     `json:"set_radius"` // with a null radius, clears it
+	Address   *string  `json:"address"`
+}
+
+var errPlaceNotFound = errors.New("place not found")
+
+func scanPlace(row pgx.Row, p *Place) error {
+	return row.Scan(&p.ID, &p.UserID, &p.Name, &p.Category, &p.Longitude, &p.Latitude,
+		&p.Radius, &p.Address, &p.CreatedAt, &p.UpdatedAt)
+}
+
+// loadPlace returns one of the user's places or errPlaceNotFound.
+func loadPlace(ctx context.Context, userID string, id int) (Place, error) {
+	var p Place
+	err := scanPlace(DB.QueryRow(ctx, `SELECT `+placeColumns+` FROM Places WHERE user_id = $1 AND id = $2`, userID, id), &p)
+	if err == pgx.ErrNoRows {
+		return p, errPlaceNotFound
+	}
+	return p, err
+}
+
+// syncHomePlace moves the user's home place to match Users.home_long/home_lat.
+func syncHomePlace(ctx context.Context, userID string, longitude, latitude float64) error {
+	_, err := DB.Exec(ctx, `
+		INSERT INTO Places (user_id, name, category, longitude, latitude)
+		VALUES ($1, 'Home', 'home', $2, $3)
+		ON CONFLICT (user_id) WHERE category = 'home' DO UPDATE SET
+			longitude = EXCLUDED.longitude, latitude = EXCLUDED.latitude, updated_at = now()
+	`, userID, longitude, latitude)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(ctx, `
+		UPDATE Fences SET longitude = $2, latitude = $3
+		WHERE place_id = (SELECT id FROM Places WHERE user_id = $1 AND category = 'home')
+	`, userID, longitude, latitude)
+	return err
+}
+
+// placeLocation is the location text an appointment at the place gets.
+func placeLocation(p Place) string {
+	if p.Address != "" {
+		return p.Name + ", " + p.Address
+	}
+	return p.Name
+}
+
+func createPlace(c echo.Context) error {
+	var req CreatePlaceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	sql := `
+		INSERT INTO Places (user_id, name, category, longitude, latitude, radius, address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + placeColumns
+
+	var place Place
+	err = scanPlace(DB.QueryRow(ctx, sql,
+		req.UserID, req.Name, req.Category, req.Longitude, req.Latitude, req.Radius, req.Address,
+	), &place)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to create place"})
+	}
+
+	return c.JSON(http.StatusCreated, place)
+}
+
+func listPlaces(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	if idStr := c.QueryParam("id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid place id"})
+		}
+		place, err := loadPlace(ctx, userID, id)
+		if err == errPlaceNotFound {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+		}
+		return c.JSON(http.StatusOK, []Place{place})
+	}
+
+	sql := `SELECT ` + placeColumns + ` FROM Places WHERE user_id = $1`
+	args := []any{userID}
+	if category := c.QueryParam("category"); category != "" {
+		sql += ` AND category = $2`
+		args = append(args, category)
+	}
+	sql += ` ORDER BY category = 'home' DESC, name ASC`
+
+	rows, err := DB.Query(ctx, sql, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch places"})
+	}
+	defer rows.Close()
+
+	places := []Place{}
+	for rows.Next() {
+		var p Place
+		if err := scanPlace(rows, &p); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to parse place"})
+		}
+		places = append(places, p)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to read places"})
+	}
+
+	return c.JSON(http.StatusOK, places)
+}
+
+func updatePlace(c echo.Context) error {
+	var req UpdatePlaceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid place id is required"})
+	}
+
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	current, err := loadPlace(ctx, userID, req.ID)
+	if err == errPlaceNotFound {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch place"})
+	}
+
+	if req.Category != nil {
+		if current.Category == homePlaceCategory && *req.Category != homePlaceCategory {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "the home place's category cannot be changed"})
+		}
+		if current.Category != homePlaceCategory && *req.Category == homePlaceCategory {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "every user already has a home place; update it instead"})
+		}
+	}
+
+	oldRadius := current.Radius
+	if req.Name != nil {
+		current.Name = *req.Name
+	}
+	if req.Category != nil {
+		current.Category = *req.Category
+	}
+	if req.Longitude != nil {
+		current.Longitude = *req.Longitude
+	}
+	if req.Latitude != nil {
+		current.Latitude = *req.Latitude
+	}
+	if req.Radius != nil || req.SetRadius {
+		current.Radius = req.Radius
+	}
+	if req.Address != nil {
+		current.Address = *req.Address
+	}
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update place"})
+	}
+	defer tx.Rollback(ctx)
+
+	err = scanPlace(tx.QueryRow(ctx, `
+		UPDATE Places
+		SET name = $1, category = $2, longitude = $3, latitude = $4, radius = $5, address = $6, updated_at = now()
+		WHERE user_id = $7 AND id = $8
+		RETURNING `+placeColumns,
+		current.Name, current.Category, current.Longitude, current.Latitude, current.Radius, current.Address,
+		userID, req.ID,
+	), &current)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update place"})
+	}
+
+	// Fences made from this place move with it, and those that took its
+	// radius rather than setting their own follow a new one
+	if _, err := tx.Exec(ctx, `
+		UPDATE Fences SET longitude = $1, latitude = $2,
+			radius = CASE WHEN $4::real IS NOT NULL AND radius = $5::real THEN $4::real ELSE radius END
+		WHERE place_id = $3
+	`, current.Longitude, current.Latitude, current.ID, current.Radius, oldRadius); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update fences"})
+	}
+	if current.Category == homePlaceCategory {
+		if _, err := tx.Exec(ctx, `UPDATE Users SET home_long = $1, home_lat = $2 WHERE user_id = $3`,
+			current.Longitude, current.Latitude, userID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update home location"})
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update place"})
+	}
+
+	return c.JSON(http.StatusOK, current)
+}
+
+func deletePlace(c echo.Context) error {
+	var req struct {
+		UserID string `json:"user_id"`
+		ID     int    `json:"id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "valid place id is required"})
+	}
+
+	ctx := c.Request().Context()
+	var category string
+	err = DB.QueryRow(ctx, `SELECT category FROM Places WHERE user_id = $1 AND id = $2`, userID, req.ID).Scan(&category)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "place not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to delete place"})
+	}
+	if category == homePlaceCategory {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "the home place cannot be deleted"})
+	}
+
+	// Fences and appointments keep their coordinates and location text
+	if _, err := DB.Exec(ctx, `DELETE FROM Places WHERE user_id = $1 AND id = $2`, userID, req.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to delete place"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "place deleted"})
+}
+
+func (r *CreatePlaceRequest) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	r.Category = strings.TrimSpace(r.Category)
+	if r.Category == "" {
+		r.Category = "other"
+	}
+	if r.Category == homePlaceCategory {
+		return errors.New("every user already has a home place; update it instead")
+	}
+	if !placeCategories[r.Category] {
+		return errors.New("unknown place category")
+	}
+	if !isValidLongitude(r.Longitude) {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if !isValidLatitude(r.Latitude) {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if r.Radius != nil && *r.Radius <= 0 {
+		return errors.New("radius must be greater than zero")
+	}
+	r.Address = strings.TrimSpace(r.Address)
+	return nil
+}
+
+func (r *UpdatePlaceRequest) Validate() error {
+	if r.Name == nil && r.Category == nil && r.Longitude == nil && r.Latitude == nil &&
+		r.Radius == nil && !r.SetRadius && r.Address == nil {
+		return errors.New("at least one field must be provided")
+	}
+	if r.Name != nil {
+		trimmed := strings.TrimSpace(*r.Name)
+		if trimmed == "" {
+			return errors.New("name cannot be empty")
+		}
+		*r.Name = trimmed
+	}
+	if r.Category != nil && !placeCategories[*r.Category] {
+		return errors.New("unknown place category")
+	}
+	if r.Longitude != nil && !isValidLongitude(*r.Longitude) {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if r.Latitude != nil && !isValidLatitude(*r.Latitude) {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if r.Radius != nil && *r.Radius <= 0 {
+		return errors.New("radius must be greater than zero")
+	}
+	if r.Address != nil {
+		*r.Address = strings.TrimSpace(*r.Address)
+	}
+	return nil
+}
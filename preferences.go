@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Per-user settings. A column left NULL in UserPreferences follows the default
+// for the user's role, so defaults can change without rewriting rows; setting
+// a string field to "" in a PATCH resets it to the default.
+//
+// Env vars:
+//   DEFAULT_TIMEZONE — timezone for users who have not picked one (default America/Toronto)
+
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+var supportedLanguages = map[string]bool{
+	"en": true,
+	"fr": true,
+}
+
+// defaultBatteryThresholds are the charge levels, in percent, that raise a
+// Low_Battery event.
+var defaultBatteryThresholds = []int{20, 10, 5}
+
+const maxBatteryThresholds = 5
+
+// eventTypes mirrors the event_type enum.
+var eventTypes = []string{"SOS", "Fall", "Low_Battery", "Geofence_Exit", "Geofence_Enter", "Heart_Rate_Alert",
+	"Device_Offline", "Device_Online"}
+
+type QuietHours struct {
+	Start string `json:"start"` // "HH:MM" in the user's timezone
+	End   string `json:"end"`   // may be earlier than Start to span midnight
+}
+
+type Preferences struct {
+	UserID            string      `json:"user_id"`
+	Units             string      `json:"units"`
+	Language          string      `json:"language"`
+	Timezone          string      `json:"timezone"`
+	NotifyEventTypes  []string    `json:"notify_event_types"`
+	QuietHours        *QuietHours `json:"quiet_hours"`
+	BatteryThresholds []int       `json:"battery_thresholds"` // highest first
+	UpdatedAt         *time.Time  `json:"updated_at"`
+}
+
+type UpdatePreferencesRequest struct {
+	UserID               string      `json:"user_id"`
+	Units                *string     `json:"units"`
+	Language             *string     `json:"language"`
+	Timezone             *string     `json:"timezone"`
+	NotifyEventTypes     *[]string   `json:"notify_event_types"`
+	QuietHours           *QuietHours `json:"quiet_hours"`
+	SetQuietHours        bool        `json:"set_quiet_hours"`        // with a null quiet_hours, turns them off
+	BatteryThresholds    *[]int      `json:"battery_thresholds"`     // an empty list turns Low_Battery events off
+	SetBatteryThresholds bool        `json:"set_battery_thresholds"` // with a null battery_thresholds, restores the defaults
+}
+
+// storedPreferences is a UserPreferences row; nil fields follow the role default.
+type storedPreferences struct {
+	Units             *string
+	Language          *string
+	Timezone          *string
+	NotifyEventTypes  []string
+	QuietStart        *string
+	QuietEnd          *string
+	BatteryThresholds []int
+	UpdatedAt         *time.Time
+}
+
+func defaultTimezone() string {
+	if v := os.Getenv("DEFAULT_TIMEZONE"); v != "" {
+		if _, err := time.LoadLocation(v); err == nil {
+			return v
+		}
+	}
+	return "America/Toronto"
+}
+
+// defaultPreferences returns the settings a user of the given role starts with.
+func defaultPreferences(role string) Preferences {
+	prefs := Preferences{
+		Units:             unitsMetric,
+		Language:          "en",
+		Timezone:          defaultTimezone(),
+		NotifyEventTypes:  []string{},
+		BatteryThresholds: slices.Clone(defaultBatteryThresholds),
+	}
+	switch role {
+	case "Caregiver":
+		prefs.NotifyEventTypes = slices.Clone(eventTypes)
+	case "Cane_User":
+		prefs.NotifyEventTypes = []string{"Low_Battery"}
+	}
+	return prefs
+}
+
+func loadStoredPreferences(ctx context.Context, db dbtx, userID string) (string, storedPreferences, error) {
+	var role string
+	var s storedPreferences
+	err := db.QueryRow(ctx, `
+		SELECT u.type, p.units, p.language, p.timezone, p.notify_event_types,
+		       to_char(p.quiet_hours_start, 'HH24:MI'), to_char(p.quiet_hours_end, 'HH24:MI'),
+		       p.battery_thresholds, p.updated_at
+		FROM Users u
+		LEFT JOIN UserPreferences p ON p.user_id = u.user_id
+		WHERE u.user_id = $1
+	`, userID).Scan(&role, &s.Units, &s.Language, &s.Timezone, &s.NotifyEventTypes, &s.QuietStart, &s.QuietEnd,
+		&s.BatteryThresholds, &s.UpdatedAt)
+	return role, s, err
+}
+
+// resolve fills unset fields with the defaults for role.
+func (s storedPreferences) resolve(userID, role string) Preferences {
+	prefs := defaultPreferences(role)
+	prefs.UserID = userID
+	prefs.UpdatedAt = s.UpdatedAt
+	if s.Units != nil {
+		prefs.Units = *s.Units
+	}
+	if s.Language != nil {
+		prefs.Language = *s.Language
+	}
+	if s.Timezone != nil {
+		prefs.Timezone = *s.Timezone
+	}
+	if s.NotifyEventTypes != nil {
+		prefs.NotifyEventTypes = s.NotifyEventTypes
+	}
+	if s.QuietStart != nil && s.QuietEnd != nil {
+		prefs.QuietHours = &QuietHours{Start: *s.QuietStart, End: *s.QuietEnd}
+	}
+	if s.BatteryThresholds != nil {
+		prefs.BatteryThresholds = s.BatteryThresholds
+	}
+	return prefs
+}
+
+// loadPreferences returns the effective settings of a user. Inside a
+// transaction pass it as db, so the query doesn't wait for a second
+// connection from the pool.
+func loadPreferences(ctx context.Context, db dbtx, userID string) (Preferences, error) {
+	role, stored, err := loadStoredPreferences(ctx, db, userID)
+	if err != nil {
+		return Preferences{}, err
+	}
+	return stored.resolve(userID, role), nil
+}
+
+// location returns the user's timezone, falling back to UTC.
+func (p Preferences) location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func getPreferences(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	prefs, err := loadPreferences(c.Request().Context(), DB, userID)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "user not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch preferences"})
+	}
+	return c.JSON(http.StatusOK, prefs)
+}
+
+func updatePreferences(c echo.Context) error {
+	var req UpdatePreferencesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	role, stored, err := loadStoredPreferences(ctx, DB, userID)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "user not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch preferences"})
+	}
+
+	if req.Units != nil {
+		stored.Units = nilIfEmpty(*req.Units)
+	}
+	if req.Language != nil {
+		stored.Language = nilIfEmpty(*req.Language)
+	}
+	if req.Timezone != nil {
+		stored.Timezone = nilIfEmpty(*req.Timezone)
+	}
+	if req.NotifyEventTypes != nil {
+		stored.NotifyEventTypes = *req.NotifyEventTypes
+	}
+	if req.QuietHours != nil {
+		stored.QuietStart, stored.QuietEnd = &req.QuietHours.Start, &req.QuietHours.End
+	} else if req.SetQuietHours {
+		stored.QuietStart, stored.QuietEnd = nil, nil
+	}
+	if req.BatteryThresholds != nil {
+		stored.BatteryThresholds = *req.BatteryThresholds
+	} else if req.SetBatteryThresholds {
+		stored.BatteryThresholds = nil
+	}
+
+	err = DB.QueryRow(ctx, `
+		INSERT INTO UserPreferences (user_id, units, language, timezone, notify_event_types, quiet_hours_start, quiet_hours_end,
+		                             battery_thresholds)
+		VALUES ($1, $2, $3, $4, $5, $6::time, $7::time, $8)
+		ON CONFLICT (user_id) DO UPDATE SET
+			units = EXCLUDED.units,
+			language = EXCLUDED.language,
+			timezone = EXCLUDED.timezone,
+			notify_event_types = EXCLUDED.notify_event_types,
+			quiet_hours_start = EXCLUDED.quiet_hours_start,
+			quiet_hours_end = EXCLUDED.quiet_hours_end,
+			battery_thresholds = EXCLUDED.battery_thresholds,
+			updated_at = now()
+		RETURNING updated_at
+	`, userID, stored.Units, stored.Language, stored.Timezone, stored.NotifyEventTypes, stored.QuietStart, stored.QuietEnd,
+		stored.BatteryThresholds,
+	).Scan(&stored.UpdatedAt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to update preferences"})
+	}
+
+	return c.JSON(http.StatusOK, stored.resolve(userID, role))
+}
+
+func (r *UpdatePreferencesRequest) Validate() error {
+	if r.Units == nil && r.Language == nil && r.Timezone == nil && r.NotifyEventTypes == nil &&
+		r.QuietHours == nil && !r.SetQuietHours && r.BatteryThresholds == nil && !r.SetBatteryThresholds {
+		return errors.New("at least one field must be provided")
+	}
+
+	if r.Units != nil {
+		*r.Units = strings.ToLower(strings.TrimSpace(*r.Units))
+		if *r.Units != "" && *r.Units != unitsMetric && *r.Units != unitsImperial {
+			return errors.New("units must be metric or imperial")
+		}
+	}
+	if r.Language != nil {
+		*r.Language = strings.ToLower(strings.TrimSpace(*r.Language))
+		if *r.Language != "" && !supportedLanguages[*r.Language] {
+			return errors.New("language must be en or fr")
+		}
+	}
+	if r.Timezone != nil {
+		*r.Timezone = strings.TrimSpace(*r.Timezone)
+		if *r.Timezone != "" {
+			if _, err := time.LoadLocation(*r.Timezone); err != nil || *r.Timezone == "Local" {
+				return errors.New("timezone must be an IANA name such as America/Toronto")
+			}
+		}
+	}
+	if r.NotifyEventTypes != nil {
+		types := []string{}
+		for _, t := range *r.NotifyEventTypes {
+			if !slices.Contains(eventTypes, t) {
+				return errors.New("unknown event type " + t)
+			}
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+		*r.NotifyEventTypes = types
+	}
+	if r.QuietHours != nil {
+		start, err := time.Parse("15:04", r.QuietHours.Start)
+		if err != nil {
+			return errors.New("quiet_hours.start must be HH:MM")
+		}
+		end, err := time.Parse("15:04", r.QuietHours.End)
+		if err != nil {
+			return errors.New("quiet_hours.end must be HH:MM")
+		}
+		if start.Equal(end) {
+			return errors.New("quiet_hours start and end must differ")
+		}
+	}
+	if r.BatteryThresholds != nil {
+		thresholds := []int{}
+		for _, t := range *r.BatteryThresholds {
+			if t < 1 || t > 99 {
+				return errors.New("battery_thresholds must be between 1 and 99")
+			}
+			if !slices.Contains(thresholds, t) {
+				thresholds = append(thresholds, t)
+			}
+		}
+		if len(thresholds) > maxBatteryThresholds {
+			return errors.New("at most 5 battery_thresholds are allowed")
+		}
+		slices.SortFunc(thresholds, func(a, b int) int { return b - a })
+		*r.BatteryThresholds = thresholds
+	}
+	return nil
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// The location history is split into stays, where the user remained within
+// STAY_RADIUS_METERS of one spot for at least STAY_MIN_MINUTES, and trips
+// between them. Segments are built as readings arrive: SegmentStates holds
+// the segment in progress and the stay candidate being watched, and each new
+// reading extends, closes or opens a segment. A stay is only left after
+// several readings in a row outside it, so one stray fix doesn't split it.
+// A gap of more than segmentMaxGap between readings closes the open segment
+// at its last reading. Stays are matched to the saved place or fence they
+// fall in.
+//
+// Ingest only ever starts a user's segmentation from scratch. History from
+// before it started (the last segmentBackfillDays of it) is replayed by a
+// background job. Late readings from a backlog are ignored, as are fixes
+// less accurate than FENCE_MAX_ACCURACY_METERS.
+//
+// Env vars:
+//   STAY_RADIUS_METERS — how far a user may wander and still be staying (default 100)
+//   STAY_MIN_MINUTES   — how long they must stay for it to count (default 10)
+
+const (
+	segmentStay = "stay"
+	segmentTrip = "trip"
+
+	stayLeaveReadings       = 2                // consecutive readings outside a stay before it ends
+	segmentMaxGap           = 30 * time.Minute // longer without a reading ends the segment
+	segmentBackfillDays     = 30
+	segmentBackfillInterval = time.Hour
+)
+
+func stayRadius() float64 {
+	if v := os.Getenv("STAY_RADIUS_METERS"); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 100
+}
+
+func stayMinDuration() time.Duration {
+	if v := os.Getenv("STAY_MIN_MINUTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Minute
+		}
+	}
+	return 10 * time.Minute
+}
+
+// Segment is a Segments row. For a stay, Longitude/Latitude is the centroid;
+// for a trip it is where the trip began and EndLongitude/EndLatitude where it
+// ended (or has got to).
+type Segment struct {
+	ID             int
+	UserID         string
+	Kind           string
+	StartAt        time.Time
+	EndAt          time.Time
+	Longitude      float64
+	Latitude       float64
+	EndLongitude   *float64
+	EndLatitude    *float64
+	Points         int
+	DistanceMeters float64
+	PlaceID        *int
+	FenceID        *int
+}
+
+type segmentPoint struct {
+	At        time.Time
+	Longitude float64
+	Latitude  float64
+}
+
+// segmentState is a SegmentStates row together with the open segment.
+type segmentState struct {
+	Open *Segment // nil before the first reading
+
+	// Readings in a row outside the open stay (or, on a trip, outside the
+	// candidate), and the distance walked from the stay's centroid through them
+	Pending         int
+	PendingDistance float64
+
+	// While on a trip, the readings since CandidateStartAt that stayed close
+	// together; the trip's distance when the candidate started
+	CandidateStartAt   *time.Time
+	CandidateLongitude float64
+	CandidateLatitude  float64
+	CandidatePoints    int
+	CandidateDistance  float64
+
+	LastRecordedAt time.Time
+	LastLongitude  float64
+	LastLatitude   float64
+
+	// The first reading segmented live; earlier ones are left to the backfill
+	StartedAt time.Time
+}
+
+func (s *segmentState) startCandidate(p segmentPoint, distance float64) {
+	at := p.At
+	s.CandidateStartAt = &at
+	s.CandidateLongitude, s.CandidateLatitude = p.Longitude, p.Latitude
+	s.CandidatePoints = 1
+	s.CandidateDistance = distance
+}
+
+// advance feeds one reading through the segmentation. It returns the segment
+// the reading closed, if any, and a trip that turned out to be no trip at all
+// and should be discarded.
+func (s *segmentState) advance(userID string, p segmentPoint, radius float64, minStay time.Duration) (closed, dropped *Segment) {
+	last := segmentPoint{At: s.LastRecordedAt, Longitude: s.LastLongitude, Latitude: s.LastLatitude}
+	s.LastRecordedAt, s.LastLongitude, s.LastLatitude = p.At, p.Longitude, p.Latitude
+
+	open := s.Open
+	if open == nil {
+		s.StartedAt = p.At
+		s.Open = newTrip(userID, p, p.At, 0)
+		s.startCandidate(p, 0)
+		return nil, nil
+	}
+	if p.At.Sub(last.At) > segmentMaxGap {
+		closed, dropped = s.finish()
+		s.Open = newTrip(userID, p, p.At, 0)
+		s.startCandidate(p, 0)
+		return closed, dropped
+	}
+
+	if open.Kind == segmentStay {
+		d := distanceMeters(p.Latitude, p.Longitude, open.Latitude, open.Longitude)
+		if d <= radius {
+			n := float64(open.Points)
+			open.Longitude = (open.Longitude*n + p.Longitude) / (n + 1)
+			open.Latitude = (open.Latitude*n + p.Latitude) / (n + 1)
+			open.Points++
+			open.EndAt = p.At
+			s.Pending, s.PendingDistance = 0, 0
+			return nil, nil
+		}
+		if s.Pending == 0 {
+			s.PendingDistance = d
+		} else {
+			s.PendingDistance += distanceMeters(last.Latitude, last.Longitude, p.Latitude, p.Longitude)
+		}
+		s.Pending++
+		if s.Pending < stayLeaveReadings {
+			return nil, nil
+		}
+
+		// Left: the trip starts when the stay's last reading was taken
+		trip := newTrip(userID, segmentPoint{At: open.EndAt, Longitude: open.Longitude, Latitude: open.Latitude}, p.At, s.PendingDistance)
+		trip.EndLongitude, trip.EndLatitude = &p.Longitude, &p.Latitude
+		trip.Points = s.Pending
+		s.Open = trip
+		s.Pending, s.PendingDistance = 0, 0
+		s.startCandidate(p, trip.DistanceMeters)
+		return open, nil
+	}
+
+	leg := distanceMeters(last.Latitude, last.Longitude, p.Latitude, p.Longitude)
+	open.DistanceMeters += leg
+	open.EndAt = p.At
+	open.EndLongitude, open.EndLatitude = &p.Longitude, &p.Latitude
+	open.Points++
+
+	if distanceMeters(p.Latitude, p.Longitude, s.CandidateLatitude, s.CandidateLongitude) > radius {
+		s.Pending++
+		if s.Pending < stayLeaveReadings {
+			return nil, nil
+		}
+		// Moved on. The new candidate starts at the previous reading if this
+		// one is close to it, which catches an arrival from its first reading.
+		s.Pending = 0
+		if leg <= radius {
+			s.startCandidate(last, open.DistanceMeters-leg)
+		} else {
+			s.startCandidate(p, open.DistanceMeters)
+			return nil, nil
+		}
+	} else {
+		s.Pending = 0
+	}
+	n := float64(s.CandidatePoints)
+	s.CandidateLongitude = (s.CandidateLongitude*n + p.Longitude) / (n + 1)
+	s.CandidateLatitude = (s.CandidateLatitude*n + p.Latitude) / (n + 1)
+	s.CandidatePoints++
+	if p.At.Sub(*s.CandidateStartAt) < minStay {
+		return nil, nil
+	}
+
+	// Still long enough to be a stay: the trip ended when the candidate began
+	stay := &Segment{
+		UserID:    userID,
+		Kind:      segmentStay,
+		StartAt:   *s.CandidateStartAt,
+		EndAt:     p.At,
+		Longitude: s.CandidateLongitude,
+		Latitude:  s.CandidateLatitude,
+		Points:    s.CandidatePoints,
+	}
+	s.Open = stay
+	s.CandidateStartAt = nil
+	s.Pending = 0
+	if !open.StartAt.Before(stay.StartAt) {
+		// The user never moved; the "trip" was only the start of the history
+		return nil, open
+	}
+	endLon, endLat := stay.Longitude, stay.Latitude
+	open.EndAt = stay.StartAt
+	open.EndLongitude, open.EndLatitude = &endLon, &endLat
+	open.DistanceMeters = s.CandidateDistance
+	open.Points -= s.CandidatePoints - 1
+	return open, nil
+}
+
+// finish closes the open segment where it stands, at its last reading. A trip
+// that never left the spot it started from is too short to be a stay and is
+// returned as dropped instead.
+func (s *segmentState) finish() (closed, dropped *Segment) {
+	open := s.Open
+	neverMoved := open != nil && open.Kind == segmentTrip &&
+		s.CandidateStartAt != nil && !open.StartAt.Before(*s.CandidateStartAt)
+	s.Open = nil
+	s.Pending, s.PendingDistance = 0, 0
+	s.CandidateStartAt = nil
+	if neverMoved {
+		return nil, open
+	}
+	return open, nil
+}
+
+func newTrip(userID string, from segmentPoint, at time.Time, distance float64) *Segment {
+	return &Segment{
+		UserID:         userID,
+		Kind:           segmentTrip,
+		StartAt:        from.At,
+		EndAt:          at,
+		Longitude:      from.Longitude,
+		Latitude:       from.Latitude,
+		EndLongitude:   &from.Longitude,
+		EndLatitude:    &from.Latitude,
+		Points:         1,
+		DistanceMeters: distance,
+	}
+}
+
+// updateSegments feeds a newly stored reading to the user's segmentation. It
+// runs in the ingest transaction.
+func updateSegments(ctx context.Context, tx pgx.Tx, userID string, r StatusRequest) error {
+	if r.Accuracy != nil && *r.Accuracy > fenceMaxAccuracy() {
+		return nil
+	}
+
+	state, found, err := loadSegmentState(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// Take the user row so two first readings don't both start a segmentation
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM Users WHERE user_id = $1 FOR UPDATE`, userID); err != nil {
+			return err
+		}
+		if state, found, err = loadSegmentState(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+	if found && !r.recordedAt.After(state.LastRecordedAt) {
+		return nil
+	}
+
+	p := segmentPoint{At: r.recordedAt, Longitude: r.Longitude, Latitude: r.Latitude}
+	closed, dropped := state.advance(userID, p, stayRadius(), stayMinDuration())
+	if dropped != nil && dropped.ID != 0 {
+		if _, err := tx.Exec(ctx, `DELETE FROM Segments WHERE id = $1`, dropped.ID); err != nil {
+			return err
+		}
+	}
+	if closed != nil {
+		if err := saveSegment(ctx, tx, closed, true); err != nil {
+			return err
+		}
+	}
+	if err := saveSegment(ctx, tx, state.Open, false); err != nil {
+		return err
+	}
+	return saveSegmentState(ctx, tx, userID, state)
+}
+
+func runSegmentBackfill() {
+	ticker := time.NewTicker(segmentBackfillInterval)
+	defer ticker.Stop()
+	for {
+		if err := backfillSegments(context.Background()); err != nil {
+			log.Printf("[segments] backfill failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// backfillSegments replays the history from before each new segmentation
+// started. A user that fails is logged and left for the next pass.
+func backfillSegments(ctx context.Context) error {
+	rows, err := DB.Query(ctx, `SELECT user_id, started_at FROM SegmentStates WHERE NOT backfilled`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		UserID    string
+		StartedAt time.Time
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowToStructByPos[pending])
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if err := backfillUserSegments(ctx, u.UserID, u.StartedAt); err != nil {
+			log.Printf("[segments] backfill for %s failed: %v", u.UserID, err)
+		}
+	}
+	return nil
+}
+
+// backfillUserSegments segments the readings before startedAt on their own,
+// closing whatever is open at the last of them, so the live state is only
+// touched to mark it backfilled once everything else is written.
+func backfillUserSegments(ctx context.Context, userID string, startedAt time.Time) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	points, err := segmentBackfill(ctx, tx, userID, startedAt)
+	if err != nil {
+		return err
+	}
+	var state segmentState
+	radius, minStay := stayRadius(), stayMinDuration()
+	save := func(closed *Segment) error {
+		if closed == nil {
+			return nil
+		}
+		return saveSegment(ctx, tx, closed, true)
+	}
+	for _, p := range points {
+		// Nothing is saved until it closes, so dropped trips have no row
+		closed, _ := state.advance(userID, p, radius, minStay)
+		if err := save(closed); err != nil {
+			return err
+		}
+	}
+	closed, _ := state.finish()
+	if err := save(closed); err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE SegmentStates SET backfilled = true WHERE user_id = $1 AND NOT backfilled`, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil // done meanwhile; roll back
+	}
+	return tx.Commit(ctx)
+}
+
+// segmentBackfill returns the readings recorded before a user's first
+// segmented one, within the backfill window, oldest first.
+func segmentBackfill(ctx context.Context, tx pgx.Tx, userID string, before time.Time) ([]segmentPoint, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT created_at, longitude, latitude FROM Stats
+		WHERE user_id = $1 AND created_at < $2 AND created_at >= $3
+		  AND (accuracy IS NULL OR accuracy <= $4)
+		ORDER BY created_at
+	`, userID, before, before.AddDate(0, 0, -segmentBackfillDays), fenceMaxAccuracy())
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (segmentPoint, error) {
+		var p segmentPoint
+		err := row.Scan(&p.At, &p.Longitude, &p.Latitude)
+		return p, err
+	})
+}
+
+func loadSegmentState(ctx context.Context, tx pgx.Tx, userID string) (segmentState, bool, error) {
+	var s segmentState
+	var seg Segment
+	var segID *int
+	var kind *string
+	var startAt, endAt *time.Time
+	var lon, lat *float64
+	var points *int
+	var distance *float64
+	err := tx.QueryRow(ctx, `
+		SELECT st.pending, st.pending_distance, st.candidate_start_at, st.candidate_longitude, st.candidate_latitude,
+		       st.candidate_points, st.candidate_distance, st.last_recorded_at, st.last_longitude, st.last_latitude,
+		       st.started_at, g.id, g.kind, g.start_at, g.end_at, g.longitude, g.latitude, g.end_longitude, g.end_latitude,
+		       g.points, g.distance_meters, g.place_id, g.fence_id
+		FROM SegmentStates st
+		LEFT JOIN Segments g ON g.id = st.segment_id
+		WHERE st.user_id = $1
+		FOR UPDATE OF st
+	`, userID).Scan(&s.Pending, &s.PendingDistance, &s.CandidateStartAt, &s.CandidateLongitude, &s.CandidateLatitude,
+		&s.CandidatePoints, &s.CandidateDistance, &s.LastRecordedAt, &s.LastLongitude, &s.LastLatitude,
+		&s.StartedAt, &segID, &kind, &startAt, &endAt, &lon, &lat, &seg.EndLongitude, &seg.EndLatitude,
+		&points, &distance, &seg.PlaceID, &seg.FenceID)
+	if err == pgx.ErrNoRows {
+		return segmentState{}, false, nil
+	} else if err != nil {
+		return segmentState{}, false, err
+	}
+	if segID != nil {
+		seg.ID, seg.UserID, seg.Kind = *segID, userID, *kind
+		seg.StartAt, seg.EndAt = *startAt, *endAt
+		seg.Longitude, seg.Latitude = *lon, *lat
+		seg.Points, seg.DistanceMeters = *points, *distance
+		s.Open = &seg
+	}
+	return s, true, nil
+}
+
+func saveSegmentState(ctx context.Context, tx pgx.Tx, userID string, s segmentState) error {
+	var segID *int
+	if s.Open != nil {
+		segID = &s.Open.ID
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO SegmentStates (user_id, segment_id, pending, pending_distance, candidate_start_at, candidate_longitude,
+		                           candidate_latitude, candidate_points, candidate_distance, last_recorded_at, last_longitude, last_latitude,
+		                           started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (user_id) DO UPDATE SET
+			segment_id = EXCLUDED.segment_id,
+			pending = EXCLUDED.pending,
+			pending_distance = EXCLUDED.pending_distance,
+			candidate_start_at = EXCLUDED.candidate_start_at,
+			candidate_longitude = EXCLUDED.candidate_longitude,
+			candidate_latitude = EXCLUDED.candidate_latitude,
+			candidate_points = EXCLUDED.candidate_points,
+			candidate_distance = EXCLUDED.candidate_distance,
+			last_recorded_at = EXCLUDED.last_recorded_at,
+			last_longitude = EXCLUDED.last_longitude,
+			last_latitude = EXCLUDED.last_latitude
+	`, userID, segID, s.Pending, s.PendingDistance, s.CandidateStartAt, s.CandidateLongitude,
+		s.CandidateLatitude, s.CandidatePoints, s.CandidateDistance, s.LastRecordedAt, s.LastLongitude, s.LastLatitude,
+		s.StartedAt)
+	return err
+}
+
+// saveSegment inserts or updates seg. Stays are matched to a place and fence
+// when they start and again when they end, as the centroid settles.
+func saveSegment(ctx context.Context, tx pgx.Tx, seg *Segment, ending bool) error {
+	if seg.Kind == segmentStay && (seg.ID == 0 || ending) {
+		if err := matchStay(ctx, tx, seg); err != nil {
+			return err
+		}
+	}
+	if seg.ID == 0 {
+		return tx.QueryRow(ctx, `
+			INSERT INTO Segments (user_id, kind, start_at, end_at, longitude, latitude, end_longitude, end_latitude,
+			                      points, distance_meters, place_id, fence_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id
+		`, seg.UserID, seg.Kind, seg.StartAt, seg.EndAt, seg.Longitude, seg.Latitude, seg.EndLongitude, seg.EndLatitude,
+			seg.Points, seg.DistanceMeters, seg.PlaceID, seg.FenceID).Scan(&seg.ID)
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE Segments SET
+			start_at = $2, end_at = $3, longitude = $4, latitude = $5, end_longitude = $6, end_latitude = $7,
+			points = $8, distance_meters = $9, place_id = $10, fence_id = $11
+		WHERE id = $1
+	`, seg.ID, seg.StartAt, seg.EndAt, seg.Longitude, seg.Latitude, seg.EndLongitude, seg.EndLatitude,
+		seg.Points, seg.DistanceMeters, seg.PlaceID, seg.FenceID)
+	return err
+}
+
+// matchStay sets the place and fence a stay's centroid falls in, the nearest
+// of each if several overlap. Places without a radius count as stayRadius.
+func matchStay(ctx context.Context, tx pgx.Tx, seg *Segment) error {
+	rows, err := tx.Query(ctx, `
+		SELECT 'place', id, longitude, latitude, COALESCE(radius, $2) FROM Places WHERE user_id = $1
+		UNION ALL
+		SELECT 'fence', id, longitude, latitude, radius FROM Fences WHERE user_id = $1
+	`, seg.UserID, stayRadius())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seg.PlaceID, seg.FenceID = nil, nil
+	var placeDistance, fenceDistance float64
+	for rows.Next() {
+		var kind string
+		var id int
+		var lon, lat, radius float64
+		if err := rows.Scan(&kind, &id, &lon, &lat, &radius); err != nil {
+			return err
+		}
+		d := distanceMeters(seg.Latitude, seg.Longitude, lat, lon)
+		if d > radius {
+			continue
+		}
+		if kind == "place" && (seg.PlaceID == nil || d < placeDistance) {
+			seg.PlaceID, placeDistance = &id, d
+		} else if kind == "fence" && (seg.FenceID == nil || d < fenceDistance) {
+			seg.FenceID, fenceDistance = &id, d
+		}
+	}
+	return rows.Err()
+}
+
+type TimelineSegment struct {
+	ID              int       `json:"id"`
+	Kind            string    `json:"kind"` // stay | trip
+	StartAt         time.Time `json:"start_at"`
+	EndAt           time.Time `json:"end_at"`
+	DurationMinutes int       `json:"duration_minutes"`
+	Ongoing         bool      `json:"ongoing"`
+	Longitude       float64   `json:"longitude"` // stay centroid, or where the trip began
+	Latitude        float64   `json:"latitude"`
+	EndLongitude    *float64  `json:"end_longitude,omitempty"`
+	EndLatitude     *float64  `json:"end_latitude,omitempty"`
+	Points          int       `json:"points"`
+	DistanceMeters  *float64  `json:"distance_meters,omitempty"`
+	AverageSpeed    *float64  `json:"average_speed,omitempty"` // m/s
+	PlaceID         *int      `json:"place_id,omitempty"`
+	PlaceName       *string   `json:"place_name,omitempty"`
+	PlaceCategory   *string   `json:"place_category,omitempty"`
+	FenceID         *int      `json:"fence_id,omitempty"`
+	FenceName       *string   `json:"fence_name,omitempty"`
+}
+
+type TimelineResponse struct {
+	UserID    string            `json:"user_id"`
+	Date      string            `json:"date"`
+	Timezone  string            `json:"timezone"`
+	StartTime time.Time         `json:"start_time"`
+	EndTime   time.Time         `json:"end_time"`
+	Segments  []TimelineSegment `json:"segments"`
+}
+
+// GET /timeline?date=YYYY-MM-DD[&user_id=]
+// The day runs midnight to midnight in the ?tz= timezone, or the user's
+// preferred one; it defaults to today. Segments overlapping the day are
+// returned whole.
+func getTimeline(c echo.Context) error {
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	loc := responseLocation(c)
+	if loc == nil {
+		prefs, err := loadPreferences(ctx, DB, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch preferences"})
+		}
+		loc = prefs.location()
+	}
+
+	day := time.Now().In(loc)
+	if v := c.QueryParam("date"); v != "" {
+		if day, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid date, please use YYYY-MM-DD"})
+		}
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	end := start.AddDate(0, 0, 1)
+
+	rows, err := DB.Query(ctx, `
+		SELECT g.id, g.kind, g.start_at, g.end_at, st.user_id IS NOT NULL, g.longitude, g.latitude,
+		       g.end_longitude, g.end_latitude, g.points, g.distance_meters,
+		       g.place_id, p.name, p.category, g.fence_id, f.name
+		FROM Segments g
+		LEFT JOIN SegmentStates st ON st.segment_id = g.id
+		LEFT JOIN Places p ON p.id = g.place_id
+		LEFT JOIN Fences f ON f.id = g.fence_id
+		WHERE g.user_id = $1 AND g.start_at < $3 AND g.end_at >= $2
+		ORDER BY g.start_at
+	`, userID, start, end)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to fetch timeline"})
+	}
+	defer rows.Close()
+
+	resp := TimelineResponse{
+		UserID:    userID,
+		Date:      start.Format(time.DateOnly),
+		Timezone:  loc.String(),
+		StartTime: start,
+		EndTime:   end,
+		Segments:  []TimelineSegment{},
+	}
+	for rows.Next() {
+		var s TimelineSegment
+		var distance float64
+		if err := rows.Scan(&s.ID, &s.Kind, &s.StartAt, &s.EndAt, &s.Ongoing, &s.Longitude, &s.Latitude,
+			&s.EndLongitude, &s.EndLatitude, &s.Points, &distance,
+			&s.PlaceID, &s.PlaceName, &s.PlaceCategory, &s.FenceID, &s.FenceName); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to scan segment"})
+		}
+		duration := s.EndAt.Sub(s.StartAt)
+		s.DurationMinutes = int(math.Round(duration.Minutes()))
+		if s.Kind == segmentTrip {
+			distance = math.Round(distance)
+			s.DistanceMeters = &distance
+			if duration > 0 {
+				speed := math.Round(distance/duration.Seconds()*100) / 100
+				s.AverageSpeed = &speed
+			}
+		}
+		resp.Segments = append(resp.Segments, s)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error reading rows"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var segmentTestStart = time.Date(2025, 11, 14, 8, 0, 0, 0, time.UTC)
+
+// segmentTestPoint is a reading minutes after segmentTestStart, metres north
+// and east of a fixed origin.
+func segmentTestPoint(minutes, north, east float64) segmentPoint {
+	const metersPerDegree = 111320.0
+	return segmentPoint{
+		At:        segmentTestStart.Add(time.Duration(minutes * float64(time.Minute))),
+		Latitude:  45 + north/metersPerDegree,
+		Longitude: -75 + east/(metersPerDegree*0.7071),
+	}
+}
+
+// segmentTestStay is one reading a minute, minutes from through to, at one spot.
+func segmentTestStay(from, to, north, east float64) []segmentPoint {
+	var points []segmentPoint
+	for m := from; m <= to; m++ {
+		points = append(points, segmentTestPoint(m, north, east))
+	}
+	return points
+}
+
+// segmentTestWalk walks north from north at 80 m a minute.
+func segmentTestWalk(from, to, north float64) []segmentPoint {
+	var points []segmentPoint
+	for m := from; m <= to; m++ {
+		points = append(points, segmentTestPoint(m, north+(m-from)*80, 0))
+	}
+	return points
+}
+
+func segmentTestPoints(parts ...[]segmentPoint) []segmentPoint {
+	var points []segmentPoint
+	for _, p := range parts {
+		points = append(points, p...)
+	}
+	return points
+}
+
+func TestSegmentStateAdvance(t *testing.T) {
+	type span struct {
+		Kind       string
+		Start, End float64 // minutes after segmentTestStart
+	}
+	tests := []struct {
+		name    string
+		points  []segmentPoint
+		closed  []span
+		dropped int
+		open    span
+	}{
+		{
+			name:    "standing still becomes a stay from the first reading",
+			points:  segmentTestStay(0, 15, 0, 0),
+			dropped: 1,
+			open:    span{segmentStay, 0, 15},
+		},
+		{
+			name:   "too short to be a stay stays a trip",
+			points: segmentTestStay(0, 5, 0, 0),
+			open:   span{segmentTrip, 0, 5},
+		},
+		{
+			name: "stay, trip, stay",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				segmentTestWalk(16, 25, 200),
+				segmentTestStay(26, 45, 1000, 0),
+			),
+			closed:  []span{{segmentStay, 0, 15}, {segmentTrip, 15, 25}},
+			dropped: 1,
+			open:    span{segmentStay, 25, 45},
+		},
+		{
+			name: "one stray fix doesn't end a stay",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				[]segmentPoint{segmentTestPoint(16, 500, 0)},
+				segmentTestStay(17, 30, 0, 0),
+			),
+			dropped: 1,
+			open:    span{segmentStay, 0, 30},
+		},
+		{
+			name: "one stray fix doesn't split a stay candidate",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				segmentTestWalk(16, 25, 200),
+				segmentTestStay(26, 30, 1000, 0),
+				[]segmentPoint{segmentTestPoint(31, 1600, 0)},
+				segmentTestStay(32, 45, 1000, 0),
+			),
+			closed:  []span{{segmentStay, 0, 15}, {segmentTrip, 15, 25}},
+			dropped: 1,
+			open:    span{segmentStay, 25, 45},
+		},
+		{
+			name: "a gap ends a stay at its last reading",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				segmentTestStay(120, 135, 0, 0),
+			),
+			closed:  []span{{segmentStay, 0, 15}},
+			dropped: 2,
+			open:    span{segmentStay, 120, 135},
+		},
+		{
+			name: "a gap ends a trip at its last reading",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				segmentTestWalk(16, 25, 200),
+				segmentTestWalk(90, 95, 5000),
+			),
+			closed:  []span{{segmentStay, 0, 15}, {segmentTrip, 15, 25}},
+			dropped: 1,
+			open:    span{segmentTrip, 90, 95},
+		},
+		{
+			name: "a short stop before a gap is dropped",
+			points: segmentTestPoints(
+				segmentTestStay(0, 5, 0, 0),
+				segmentTestStay(60, 75, 0, 0),
+			),
+			dropped: 2,
+			open:    span{segmentStay, 60, 75},
+		},
+		{
+			name: "readings up to the maximum gap apart stay together",
+			points: segmentTestPoints(
+				segmentTestStay(0, 15, 0, 0),
+				segmentTestStay(15+segmentMaxGap.Minutes(), 15+segmentMaxGap.Minutes(), 0, 0),
+			),
+			dropped: 1,
+			open:    span{segmentStay, 0, 15 + segmentMaxGap.Minutes()},
+		},
+	}
+
+	minutes := func(at time.Time) float64 { return at.Sub(segmentTestStart).Minutes() }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s segmentState
+			var closed []span
+			dropped := 0
+			for _, p := range tt.points {
+				c, d := s.advance("user", p, 100, 10*time.Minute)
+				if c != nil {
+					closed = append(closed, span{c.Kind, minutes(c.StartAt), minutes(c.EndAt)})
+				}
+				if d != nil {
+					dropped++
+				}
+			}
+
+			if len(closed) != len(tt.closed) {
+				t.Fatalf("closed %v, want %v", closed, tt.closed)
+			}
+			for i := range closed {
+				if closed[i] != tt.closed[i] {
+					t.Errorf("closed[%d] = %v, want %v", i, closed[i], tt.closed[i])
+				}
+			}
+			if dropped != tt.dropped {
+				t.Errorf("dropped %d, want %d", dropped, tt.dropped)
+			}
+			open := span{s.Open.Kind, minutes(s.Open.StartAt), minutes(s.Open.EndAt)}
+			if open != tt.open {
+				t.Errorf("open %v, want %v", open, tt.open)
+			}
+		})
+	}
+}
+
+func TestSegmentStateFinish(t *testing.T) {
+	tests := []struct {
+		name    string
+		points  []segmentPoint
+		closed  string
+		dropped bool
+	}{
+		{name: "nothing open", closed: "", dropped: false},
+		{name: "stay", points: segmentTestStay(0, 15, 0, 0), closed: segmentStay},
+		{
+			name:   "trip",
+			points: segmentTestPoints(segmentTestStay(0, 15, 0, 0), segmentTestWalk(16, 25, 200)),
+			closed: segmentTrip,
+		},
+		{name: "short stop", points: segmentTestStay(0, 5, 0, 0), dropped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s segmentState
+			for _, p := range tt.points {
+				s.advance("user", p, 100, 10*time.Minute)
+			}
+			closed, dropped := s.finish()
+			kind := ""
+			if closed != nil {
+				kind = closed.Kind
+			}
+			if kind != tt.closed || (dropped != nil) != tt.dropped {
+				t.Errorf("finish() = %q, dropped %v; want %q, dropped %v", kind, dropped != nil, tt.closed, tt.dropped)
+			}
+			if s.Open != nil || s.CandidateStartAt != nil || s.Pending != 0 {
+				t.Errorf("state not reset: %+v", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SessionResponse struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Current    bool       `json:"current"`
+}
+
+type RenameSessionRequest struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type RevokeSessionRequest struct {
+	ID int `json:"id"`
+}
+
+var errAccountDisabled = errors.New("account disabled")
+
+// startSession creates a Sessions row for userID and sets the session cookie.
+// It refuses with errAccountDisabled once an admin has disabled the account.
+func startSession(c echo.Context, userID, name string) error {
+	sessionToken, err := generateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(sessionDuration)
+
+	sql := `
+		INSERT INTO Sessions (user_id, token_hash, expires_at, name, user_agent, ip_address, last_seen_at)
+		SELECT user_id, $2, $3, $4, $5, $6, now() FROM Users WHERE user_id = $1 AND disabled_at IS NULL
+	`
+	tag, err := DB.Exec(c.Request().Context(), sql,
+		userID, hashToken(sessionToken), expiresAt,
+		strings.TrimSpace(name), c.Request().UserAgent(), c.RealIP(),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errAccountDisabled
+	}
+
+	setSessionCookie(c, sessionToken, expiresAt)
+	return nil
+}
+
+// touchSession records activity on a session. last_seen_at only needs minute
+// resolution, so most requests skip the write.
+func touchSession(ctx context.Context, sessionID int) error {
+	_, err := DB.Exec(ctx, `
+		UPDATE Sessions SET last_seen_at = now()
+		WHERE id = $1 AND (last_seen_at IS NULL OR last_seen_at < now() - interval '1 minute')
+	`, sessionID)
+	return err
+}
+
+// deleteOtherSessions deletes every session of userID except keepID.
+func deleteOtherSessions(ctx context.Context, userID string, keepID int) error {
+	_, err := DB.Exec(ctx, `DELETE FROM Sessions WHERE user_id = $1 AND id <> $2`, userID, keepID)
+	return err
+}
+
+// GET /sessions - List the caller's active sessions
+func listSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+	sql := `
+		SELECT id, name, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM Sessions
+		WHERE user_id = $1 AND expires_at > now()
+		ORDER BY last_seen_at DESC NULLS LAST
+	`
+	rows, err := DB.Query(ctx, sql, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to retrieve sessions"})
+	}
+	defer rows.Close()
+
+	currentID := currentSessionID(c)
+	sessions := []SessionResponse{}
+	for rows.Next() {
+		var s SessionResponse
+		if err := rows.Scan(&s.ID, &s.Name, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan session"})
+		}
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over sessions"})
+	}
+
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// PUT /sessions - Name one of the caller's sessions, e.g. "Kitchen tablet"
+func renameSession(c echo.Context) error {
+	var req RenameSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Valid session id is required"})
+	}
+
+	ctx := c.Request().Context()
+	cmdTag, err := DB.Exec(ctx, `UPDATE Sessions SET name = $1 WHERE id = $2 AND user_id = $3`,
+		strings.TrimSpace(req.Name), req.ID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to rename session"})
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Session not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Session renamed"})
+}
+
+// DELETE /sessions - Revoke one of the caller's sessions
+func revokeSession(c echo.Context) error {
+	var req RevokeSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.ID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Valid session id is required"})
+	}
+
+	ctx := c.Request().Context()
+	cmdTag, err := DB.Exec(ctx, `DELETE FROM Sessions WHERE id = $1 AND user_id = $2`, req.ID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke session"})
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Session not found"})
+	}
+
+	if req.ID == currentSessionID(c) {
+		clearSessionCookie(c)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Session revoked"})
+}
+
+// DELETE /sessions/others - Sign out everywhere except the current session
+func revokeOtherSessions(c echo.Context) error {
+	if err := deleteOtherSessions(c.Request().Context(), currentUser(c).UserID, currentSessionID(c)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke sessions"})
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "Signed out of all other sessions"})
+}
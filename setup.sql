@@ -2,7 +2,8 @@ CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
 CREATE TYPE user_role AS ENUM (
     'Cane_User',
-    'Caregiver'
+    'Caregiver',
+    'Admin'
 );
 
 CREATE TYPE event_type AS ENUM (
@@ -10,7 +11,10 @@ CREATE TYPE event_type AS ENUM (
     'Fall',
     'Low_Battery',
     'Geofence_Exit',
-    'Geofence_Enter'
+    'Geofence_Enter',
+    'Heart_Rate_Alert',
+    'Device_Offline',
+    'Device_Online'
 );
 
 CREATE TABLE Users (
@@ -24,6 +28,13 @@ CREATE TABLE Users (
     home_long DOUBLE PRECISION NOT NULL,
     home_lat DOUBLE PRECISION NOT NULL,
     avatar_url TEXT NOT NULL DEFAULT '',
+    avatar_key TEXT NULL, -- storage key prefix of an uploaded avatar
+    email_verified_at TIMESTAMPTZ NULL,
+    totp_secret TEXT NULL, -- base32, pending until totp_enabled_at is set
+    totp_enabled_at TIMESTAMPTZ NULL,
+    totp_last_step BIGINT NULL, -- last accepted TOTP step, prevents code replay
+    disabled_at TIMESTAMPTZ NULL, -- set by an admin; blocks sign-in and device keys
+    disabled_reason TEXT NOT NULL DEFAULT '',
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
@@ -32,21 +43,155 @@ CREATE TABLE Users (
 
 
 CREATE TABLE Sessions (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE, -- HMAC-SHA256 of the cookie token, keyed by SESSION_SECRET
+    name TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE PasswordResets (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE, -- HMAC-SHA256 of the emailed token
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ NULL
+);
+
+CREATE TABLE EmailVerifications (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    email TEXT NOT NULL, -- the address the token confirms
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ NULL
+);
+
+CREATE TABLE RecoveryCodes (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at TIMESTAMPTZ NULL
+);
+
+CREATE TABLE LoginChallenges (
     id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
     user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
     token_hash TEXT NOT NULL UNIQUE,
+    session_name TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     expires_at TIMESTAMPTZ NOT NULL
 );
 
+-- Failed sign-ins per "email:<address>" or "ip:<address>" key
+CREATE TABLE LoginThrottles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ NULL
+);
+
+CREATE TABLE Devices (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    key_prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE, -- HMAC-SHA256 of the API key, keyed by SESSION_SECRET
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    rotated_at TIMESTAMPTZ NULL,
+    last_used_at TIMESTAMPTZ NULL,
+    revoked_at TIMESTAMPTZ NULL
+);
+
 CREATE TABLE Stats (
     id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
     user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
     longitude DOUBLE PRECISION NOT NULL,
     latitude DOUBLE PRECISION NOT NULL,
+    accuracy REAL NULL, -- meters; NULL when the device did not report fix quality
+    speed REAL NULL, -- m/s
+    heading REAL NULL, -- degrees from true north
+    altitude REAL NULL, -- meters
+    satellites SMALLINT NULL,
+    location_source TEXT NULL, -- gps | network | wifi | cell | fused
     battery SMALLINT NOT NULL,
     heart_rate SMALLINT NULL,
-    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    skin_contact BOOLEAN NULL, -- false when the heart-rate sensor had no skin contact; NULL when not reported
+    device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(), -- when the reading was taken (the device's recorded_at)
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now() -- when the server received it
+);
+
+-- Per-user settings; NULL columns follow the defaults for the user's role
+CREATE TABLE UserPreferences (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    units TEXT NULL, -- metric | imperial
+    language TEXT NULL, -- en | fr
+    timezone TEXT NULL, -- IANA name
+    notify_event_types TEXT[] NULL,
+    quiet_hours_start TIME NULL,
+    quiet_hours_end TIME NULL,
+    battery_thresholds SMALLINT[] NULL, -- Low_Battery levels in percent; empty turns them off
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Low_Battery alerting state: the lowest threshold already reported in the
+-- current discharge
+CREATE TABLE BatteryStates (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    alerted_threshold SMALLINT NULL,
+    last_battery SMALLINT NOT NULL,
+    last_recorded_at TIMESTAMPTZ NOT NULL
+);
+
+-- Heart-rate alert bounds; users without a row get the defaults in heartrate.go
+CREATE TABLE HeartRateRules (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    low_bpm SMALLINT NOT NULL,
+    resting_max_bpm SMALLINT NOT NULL, -- while stationary
+    high_bpm SMALLINT NOT NULL,
+    sustained_minutes SMALLINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Heart-rate rules currently in an alerted episode
+CREATE TABLE HeartRateStates (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    active_rules TEXT[] NOT NULL DEFAULT '{}',
+    last_recorded_at TIMESTAMPTZ NOT NULL
+);
+
+-- When each user's cane was last heard from; maintained by ingest and the
+-- offline watchdog
+CREATE TABLE Connectivity (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    online BOOLEAN NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL, -- received_at of the latest reading
+    last_device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL,
+    changed_at TIMESTAMPTZ NOT NULL
+);
+
+-- Emergency medical profile of a cane user, attached to SOS and Fall events
+CREATE TABLE MedicalProfiles (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    conditions TEXT[] NOT NULL DEFAULT '{}',
+    medications TEXT[] NOT NULL DEFAULT '{}',
+    allergies TEXT[] NOT NULL DEFAULT '{}',
+    blood_type TEXT NOT NULL DEFAULT '', -- A+, A-, B+, B-, AB+, AB-, O+, O- or unknown
+    preferred_hospital TEXT NOT NULL DEFAULT '',
+    emergency_contacts JSONB NOT NULL DEFAULT '[]', -- [{name, relationship, phone}]
+    notes TEXT NOT NULL DEFAULT '',
+    updated_by UUID NULL REFERENCES Users(user_id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 CREATE TABLE Events (
@@ -55,9 +200,25 @@ CREATE TABLE Events (
     type event_type NOT NULL,
     name TEXT NOT NULL,
     description TEXT NOT NULL,
+    device_id INTEGER NULL REFERENCES Devices(id) ON DELETE SET NULL,
+    details JSONB NULL, -- context of server-generated events, e.g. the fence crossed
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Saved locations; every user has exactly one 'home' place mirroring Users.home_long/home_lat
+CREATE TABLE Places (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    category TEXT NOT NULL DEFAULT 'other',
+    longitude DOUBLE PRECISION NOT NULL,
+    latitude DOUBLE PRECISION NOT NULL,
+    radius REAL NULL,
+    address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE TABLE Fences (
     id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
     user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
@@ -69,9 +230,88 @@ CREATE TABLE Fences (
     starts_at TIMESTAMPTZ NULL,
     ends_at TIMESTAMPTZ NULL,
     timed_title TEXT NOT NULL DEFAULT '',
+    place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Which side of each active fence the user was last seen on. longitude,
+-- latitude and radius are the fence geometry the state was computed for.
+CREATE TABLE FenceStates (
+    fence_id INTEGER PRIMARY KEY REFERENCES Fences(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    inside BOOLEAN NOT NULL,
+    pending SMALLINT NOT NULL DEFAULT 0, -- consecutive readings past the edge on the other side
+    last_recorded_at TIMESTAMPTZ NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL,
+    latitude DOUBLE PRECISION NOT NULL,
+    radius REAL NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL
+);
+
+-- Stays (time spent within STAY_RADIUS_METERS of one spot) and the trips
+-- between them, built from Stats as readings arrive
+CREATE TABLE Segments (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    kind TEXT NOT NULL, -- stay | trip
+    start_at TIMESTAMPTZ NOT NULL,
+    end_at TIMESTAMPTZ NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL, -- stay centroid, or where the trip began
+    latitude DOUBLE PRECISION NOT NULL,
+    end_longitude DOUBLE PRECISION NULL, -- where the trip ended; NULL for stays
+    end_latitude DOUBLE PRECISION NULL,
+    points INTEGER NOT NULL, -- readings in the segment
+    distance_meters DOUBLE PRECISION NOT NULL DEFAULT 0, -- trips only
+    place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL, -- place a stay was in
+    fence_id INTEGER NULL REFERENCES Fences(id) ON DELETE SET NULL -- fence a stay was in
+);
+
+-- Segmentation progress: the segment still open and the stay candidate being
+-- watched while on a trip
+CREATE TABLE SegmentStates (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    segment_id INTEGER NULL REFERENCES Segments(id) ON DELETE SET NULL,
+    pending SMALLINT NOT NULL DEFAULT 0, -- consecutive readings outside the open stay, or the stay candidate on a trip
+    pending_distance DOUBLE PRECISION NOT NULL DEFAULT 0,
+    candidate_start_at TIMESTAMPTZ NULL,
+    candidate_longitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+    candidate_latitude DOUBLE PRECISION NOT NULL DEFAULT 0,
+    candidate_points INTEGER NOT NULL DEFAULT 0,
+    candidate_distance DOUBLE PRECISION NOT NULL DEFAULT 0, -- trip distance when the candidate began
+    last_recorded_at TIMESTAMPTZ NOT NULL,
+    last_longitude DOUBLE PRECISION NOT NULL,
+    last_latitude DOUBLE PRECISION NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL, -- first reading segmented live
+    backfilled BOOLEAN NOT NULL DEFAULT false -- history before started_at has been segmented
+);
+
+-- Activity summary of each finished day, midnight to midnight in timezone
+-- (the user's preferred one when it was computed); see activity.go
+CREATE TABLE DailySummaries (
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    timezone TEXT NOT NULL,
+    readings INTEGER NOT NULL,
+    distance_meters DOUBLE PRECISION NOT NULL, -- walked
+    active_minutes INTEGER NOT NULL,
+    home_minutes INTEGER NOT NULL,
+    outdoor_minutes INTEGER NOT NULL,
+    trips INTEGER NOT NULL,
+    avg_heart_rate REAL NULL,
+    max_heart_rate SMALLINT NULL,
+    charge_cycles REAL NOT NULL, -- battery points gained / 100
+    computed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, day)
+);
+
+-- Last day whose summary runDailySummaries has stored, in timezone; NULL
+-- until the first pass. Late readings move it back.
+CREATE TABLE ActivityWatermarks (
+    user_id UUID PRIMARY KEY REFERENCES Users(user_id) ON DELETE CASCADE,
+    timezone TEXT NOT NULL,
+    summarized_through DATE NULL
+);
+
 -- Migration for existing databases:
 -- ALTER TABLE Fences ADD COLUMN IF NOT EXISTS starts_at TIMESTAMPTZ NULL;
 -- ALTER TABLE Fences ADD COLUMN IF NOT EXISTS ends_at TIMESTAMPTZ NULL;
@@ -86,6 +326,7 @@ CREATE TABLE Appointments (
     start_at TIMESTAMPTZ NOT NULL,
     end_at TIMESTAMPTZ NULL,
     fence_id INTEGER NULL REFERENCES Fences(id) ON DELETE SET NULL,
+    place_id INTEGER NULL REFERENCES Places(id) ON DELETE SET NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
@@ -107,16 +348,41 @@ CREATE TABLE Guardians (
 );
 
 
+-- Every action taken through the /admin routes. target_user_id has no foreign
+-- key so entries outlive the accounts they are about.
+CREATE TABLE AdminAudit (
+    id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    admin_user_id UUID NULL REFERENCES Users(user_id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    target_user_id UUID NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE INDEX idx_sessions_user_id ON Sessions(user_id);
 
+CREATE INDEX idx_password_resets_user_id ON PasswordResets(user_id);
+CREATE INDEX idx_email_verifications_user_id ON EmailVerifications(user_id);
+CREATE INDEX idx_recovery_codes_user_id ON RecoveryCodes(user_id);
+
+CREATE INDEX idx_devices_user_id ON Devices(user_id);
+
 CREATE INDEX idx_stats_user_id ON Stats(user_id);
 CREATE INDEX idx_stats_created_at ON Stats(created_at DESC);
+CREATE UNIQUE INDEX idx_stats_device_recorded ON Stats(device_id, created_at) WHERE device_id IS NOT NULL;
+CREATE INDEX idx_stats_user_created ON Stats(user_id, created_at);
 
 CREATE INDEX idx_events_user_id ON Events(user_id);
 CREATE INDEX idx_events_type ON Events(type);
 CREATE INDEX idx_events_created_at ON Events(created_at DESC);
 
+CREATE INDEX idx_places_user_id ON Places(user_id);
+CREATE UNIQUE INDEX idx_places_user_home ON Places(user_id) WHERE category = 'home';
+
 CREATE INDEX idx_fences_user_id ON Fences(user_id);
+CREATE INDEX idx_fence_states_user_id ON FenceStates(user_id);
+CREATE INDEX idx_segments_user_start ON Segments(user_id, start_at);
 
 CREATE INDEX idx_appointments_user_id ON Appointments(user_id);
 CREATE INDEX idx_appointments_start_at ON Appointments(start_at ASC);
@@ -125,4 +391,10 @@ CREATE INDEX idx_invites_user_id ON Invites(user_id);
 CREATE INDEX idx_invites_email ON Invites(email);
 
 CREATE INDEX idx_guardians_cane_user_id ON Guardians(cane_user_id);
-CREATE INDEX idx_guardians_caregiver_user_id ON Guardians(caregiver_user_id);
\ No newline at end of file
+CREATE INDEX idx_guardians_caregiver_user_id ON Guardians(caregiver_user_id);
+
+CREATE INDEX idx_admin_audit_target_user_id ON AdminAudit(target_user_id);
+CREATE INDEX idx_admin_audit_admin_user_id ON AdminAudit(admin_user_id);
+CREATE INDEX idx_admin_audit_created_at ON AdminAudit(created_at DESC);
+
+CREATE INDEX idx_connectivity_online_last_seen ON Connectivity(last_seen_at) WHERE online;
@@ -2,7 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -11,16 +17,53 @@ import (
 
 const iso8601Format = time.RFC3339
 
+// locationSources are the ways a cane can fix its position. Network and cell
+// fixes are often hundreds of meters out; accuracy says by how much.
+var locationSources = map[string]bool{
+	"gps":     true,
+	"network": true,
+	"wifi":    true,
+	"cell":    true,
+	"fused":   true,
+}
+
+// fenceMaxAccuracy is the worst horizontal accuracy, in meters, a fix may
+// have and still count for geofences.
+func fenceMaxAccuracy() float64 {
+	if v := os.Getenv("FENCE_MAX_ACCURACY_METERS"); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 100
+}
+
+// locationColumns are the Fix columns of Stats, in field order.
+const locationColumns = `longitude, latitude, accuracy, speed, heading, altitude, satellites, location_source`
+
+// Fix is a position with what the cane reported about its quality. Readings
+// from before these were collected have them all null.
+type Fix struct {
+	Longitude  float64  `json:"longitude"`
+	Latitude   float64  `json:"latitude"`
+	Accuracy   *float64 `json:"accuracy"`   // meters, 68% confidence radius
+	Speed      *float64 `json:"speed"`      // meters per second
+	Heading    *float64 `json:"heading"`    // degrees clockwise from true north
+	Altitude   *float64 `json:"altitude"`   // meters above sea level
+	Satellites *int     `json:"satellites"` // used in the fix
+	Source     *string  `json:"source"`     // one of locationSources
+}
+
 type LocationResponse struct {
-	ID        int       `json:"id"`
-	Longitude float64   `json:"longitude"`
-	Latitude  float64   `json:"latitude"`
+	ID int `json:"id"`
+	Fix
 	CreatedAt time.Time `json:"created_at"`
 }
 
 type GetLocationRequest struct {
-	UserID   string `json:"user_id"`
-	Quantity int    `json:"quantity"`
+	UserID      string   `json:"user_id"`
+	Quantity    int      `json:"quantity"`
+	MaxAccuracy *float64 `json:"max_accuracy"` // leave out fixes less accurate than this many meters
 }
 
 // GET /Location - Get recent locations for a user
@@ -32,10 +75,9 @@ func getLocation(c echo.Context) error {
 		})
 	}
 
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id is required",
-		})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	if req.Quantity <= 0 {
@@ -44,15 +86,22 @@ func getLocation(c echo.Context) error {
 		})
 	}
 
+	if req.MaxAccuracy != nil && *req.MaxAccuracy <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "max_accuracy must be a positive number of meters",
+		})
+	}
+
 	query := `
-		SELECT id, longitude, latitude, created_at
+		SELECT id, ` + locationColumns + `, created_at
 		FROM stats
 		WHERE user_id = $1
+		  AND ($3::float8 IS NULL OR accuracy IS NULL OR accuracy <= $3)
 		ORDER BY created_at DESC
 		LIMIT $2
 	`
 
-	rows, err := DB.Query(context.Background(), query, req.UserID, req.Quantity)
+	rows, err := DB.Query(context.Background(), query, userID, req.Quantity, req.MaxAccuracy)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "failed to fetch locations",
@@ -63,7 +112,8 @@ func getLocation(c echo.Context) error {
 	var locations []LocationResponse
 	for rows.Next() {
 		var loc LocationResponse
-		if err := rows.Scan(&loc.ID, &loc.Longitude, &loc.Latitude, &loc.CreatedAt); err != nil {
+		if err := rows.Scan(&loc.ID, &loc.Longitude, &loc.Latitude, &loc.Accuracy, &loc.Speed, &loc.Heading,
+			&loc.Altitude, &loc.Satellites, &loc.Source, &loc.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "failed to scan location data",
 			})
@@ -81,9 +131,10 @@ func getLocation(c echo.Context) error {
 }
 
 type GetByTimeRequest struct {
-	UserID    string `json:"user_id"`
-	StartTime string `json:"start_time"`
-	EndTime   string `json:"end_time"`
+	UserID      string   `json:"user_id"`
+	StartTime   string   `json:"start_time"`
+	EndTime     string   `json:"end_time"`
+	MaxAccuracy *float64 `json:"max_accuracy"` // locations only: leave out fixes less accurate than this many meters
 }
 
 // GET /LocationByTime - Get locations for a user within a time range
@@ -95,9 +146,14 @@ func getLocationByTime(c echo.Context) error {
 		})
 	}
 
-	if req.UserID == "" || req.StartTime == "" || req.EndTime == "" {
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	if req.StartTime == "" || req.EndTime == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id, start_time, and end_time are required",
+			"error": "start_time and end_time are required",
 		})
 	}
 
@@ -122,16 +178,23 @@ func getLocationByTime(c echo.Context) error {
 		})
 	}
 
+	if req.MaxAccuracy != nil && *req.MaxAccuracy <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "max_accuracy must be a positive number of meters",
+		})
+	}
+
 	query := `
-		SELECT id, longitude, latitude, created_at
+		SELECT id, ` + locationColumns + `, created_at
 		FROM stats
 		WHERE user_id = $1
 		  AND created_at >= $2
 		  AND created_at <= $3
+		  AND ($4::float8 IS NULL OR accuracy IS NULL OR accuracy <= $4)
 		ORDER BY created_at DESC
 	`
 
-	rows, err := DB.Query(context.Background(), query, req.UserID, start, end)
+	rows, err := DB.Query(context.Background(), query, userID, start, end, req.MaxAccuracy)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "failed to fetch locations",
@@ -142,7 +205,8 @@ func getLocationByTime(c echo.Context) error {
 	var locations []LocationResponse
 	for rows.Next() {
 		var loc LocationResponse
-		if err := rows.Scan(&loc.ID, &loc.Longitude, &loc.Latitude, &loc.CreatedAt); err != nil {
+		if err := rows.Scan(&loc.ID, &loc.Longitude, &loc.Latitude, &loc.Accuracy, &loc.Speed, &loc.Heading,
+			&loc.Altitude, &loc.Satellites, &loc.Source, &loc.CreatedAt); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "failed to scan location data",
 			})
@@ -176,10 +240,9 @@ func getBattery(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 	}
 
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id is required",
-		})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `
@@ -191,7 +254,7 @@ func getBattery(c echo.Context) error {
 	`
 
 	var batteryRecord BatteryResponse
-	err := DB.QueryRow(context.Background(), query, req.UserID).Scan(
+	err = DB.QueryRow(context.Background(), query, userID).Scan(
 		&batteryRecord.ID,
 		&batteryRecord.Battery,
 		&batteryRecord.CreatedAt,
@@ -229,10 +292,9 @@ func getHeartRate(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 	}
 
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id is required",
-		})
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	if req.Quantity <= 0 {
@@ -249,7 +311,7 @@ func getHeartRate(c echo.Context) error {
 		LIMIT $2
 	`
 
-	rows, err := DB.Query(context.Background(), query, req.UserID, req.Quantity)
+	rows, err := DB.Query(context.Background(), query, userID, req.Quantity)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "failed to fetch heart rate data",
@@ -284,9 +346,14 @@ func getHeartRateByTime(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 	}
 
-	if req.UserID == "" || req.StartTime == "" || req.EndTime == "" {
+	userID, err := targetUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	if req.StartTime == "" || req.EndTime == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id, start_time, and end_time are required",
+			"error": "start_time and end_time are required",
 		})
 	}
 
@@ -320,7 +387,7 @@ func getHeartRateByTime(c echo.Context) error {
 		ORDER BY created_at DESC
 	`
 
-	rows, err := DB.Query(context.Background(), query, req.UserID, start, end)
+	rows, err := DB.Query(context.Background(), query, userID, start, end)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "failed to fetch heart rate data",
@@ -348,16 +415,153 @@ func getHeartRateByTime(c echo.Context) error {
 	return c.JSON(http.StatusOK, heartRates)
 }
 
+// Readings carry the time the cane took them (recorded_at), so readings
+// buffered while it was offline keep their real times when they are finally
+// uploaded. Stats.created_at holds the recorded time and received_at the
+// upload time; a device never stores two readings for the same instant, so
+// retried uploads are harmless.
+const (
+	maxStatusBatch       = 500
+	statusMaxClockSkew   = 5 * time.Minute
+	statusMaxBacklogDays = 30
+)
+
 type StatusRequest struct {
-	UserID    string  `json:"user_id"`
-	Longitude float64 `json:"longitude"`
-	Latitude  float64 `json:"latitude"`
-	Battery   int     `json:"battery"`
-	HeartRate *int    `json:"heart_rate,omitempty"`
+	UserID string `json:"user_id"`
+	Fix
+	Battery     int    `json:"battery"`
+	HeartRate   *int   `json:"heart_rate,omitempty"`
+	SkinContact *bool  `json:"skin_contact,omitempty"` // false when the heart-rate sensor had no contact
+	RecordedAt  string `json:"recorded_at"`            // RFC 3339, optional; defaults to the time received
+
+	recordedAt time.Time
+}
+
+type BatchStatusRequest struct {
+	UserID   string            `json:"user_id"`
+	Readings []json.RawMessage `json:"readings"`
+}
+
+type BatchStatusResult struct {
+	Index      int        `json:"index"`
+	Status     string     `json:"status"` // created | duplicate | invalid
+	ID         *int       `json:"id,omitempty"`
+	RecordedAt *time.Time `json:"recorded_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type BatchStatusResponse struct {
+	Created    int                 `json:"created"`
+	Duplicates int                 `json:"duplicates"`
+	Invalid    int                 `json:"invalid"`
+	Results    []BatchStatusResult `json:"results"`
+}
+
+// Validate checks a reading and resolves its recorded time against now.
+func (r *StatusRequest) Validate(now time.Time) error {
+	if r.Longitude < -180 || r.Longitude > 180 ||
+		r.Latitude < -90 || r.Latitude > 90 {
+		return errors.New("invalid latitude/longitude range")
+	}
+	if r.Battery < 0 || r.Battery > 100 {
+		return errors.New("battery must be between 0 and 100")
+	}
+	if r.HeartRate != nil && (*r.HeartRate < 0 || *r.HeartRate > 300) {
+		return errors.New("heart_rate must be between 0 and 300")
+	}
+	if r.Accuracy != nil && *r.Accuracy < 0 {
+		return errors.New("accuracy cannot be negative")
+	}
+	if r.Speed != nil && (*r.Speed < 0 || *r.Speed > 100) {
+		return errors.New("speed must be between 0 and 100 m/s")
+	}
+	if r.Heading != nil && (*r.Heading < 0 || *r.Heading >= 360) {
+		return errors.New("heading must be at least 0 and less than 360 degrees")
+	}
+	if r.Altitude != nil && (*r.Altitude < -500 || *r.Altitude > 9000) {
+		return errors.New("altitude must be between -500 and 9000 meters")
+	}
+	if r.Satellites != nil && (*r.Satellites < 0 || *r.Satellites > 100) {
+		return errors.New("satellites must be between 0 and 100")
+	}
+	if r.Source != nil {
+		source := strings.ToLower(strings.TrimSpace(*r.Source))
+		if source == "" {
+			r.Source = nil
+		} else if !locationSources[source] {
+			return errors.New("source must be one of gps, network, wifi, cell or fused")
+		} else {
+			r.Source = &source
+		}
+	}
+
+	r.recordedAt = now
+	if r.RecordedAt != "" {
+		t, err := time.Parse(time.RFC3339Nano, r.RecordedAt)
+		if err != nil {
+			return errors.New("invalid recorded_at format, please use ISO 8601 format (e.g., 2025-11-14T00:00:00Z)")
+		}
+		if t.After(now.Add(statusMaxClockSkew)) {
+			return errors.New("recorded_at is in the future")
+		}
+		if t.Before(now.AddDate(0, 0, -statusMaxBacklogDays)) {
+			return errors.New("recorded_at is more than 30 days old")
+		}
+		r.recordedAt = t
+	}
+	return nil
+}
+
+// insertStatus stores a validated reading. It reports created=false when the
+// device already uploaded a reading recorded at the same time.
+func insertStatus(ctx context.Context, db pgx.Tx, userID string, deviceID *int, r StatusRequest) (id int, created bool, err error) {
+	query := `
+		INSERT INTO stats (user_id, battery, heart_rate, device_id, created_at, ` + locationColumns + `, skin_contact)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (device_id, created_at) WHERE device_id IS NOT NULL DO NOTHING
+		RETURNING id
+	`
+	err = db.QueryRow(ctx, query,
+		userID, r.Battery, r.HeartRate, deviceID, r.recordedAt,
+		r.Longitude, r.Latitude, r.Accuracy, r.Speed, r.Heading, r.Altitude, r.Satellites, r.Source, r.SkinContact,
+	).Scan(&id)
+	if err == pgx.ErrNoRows {
+		// Already stored, but it still shows the cane is reachable
+		return 0, false, markOnline(ctx, db, userID, deviceID)
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	if err := afterStatus(ctx, db, userID, deviceID, id, r); err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// afterStatus runs the checks that react to a new reading, in the same
+// transaction so a reading and the events it causes are stored together.
+func afterStatus(ctx context.Context, tx pgx.Tx, userID string, deviceID *int, statID int, r StatusRequest) error {
+	if err := markOnline(ctx, tx, userID, deviceID); err != nil {
+		return err
+	}
+	if err := evaluateFences(ctx, tx, userID, deviceID, statID, r); err != nil {
+		return err
+	}
+	if err := updateSegments(ctx, tx, userID, r); err != nil {
+		return err
+	}
+	if err := checkBattery(ctx, tx, userID, deviceID, statID, r); err != nil {
+		return err
+	}
+	if err := checkHeartRate(ctx, tx, userID, deviceID, r); err != nil {
+		return err
+	}
+	return invalidateDailySummary(ctx, tx, userID, r)
 }
 
 // POST /Status - Create a new stats record
-// Body: user_id, longitude, latitude, battery, heart_rate (optional)
+// Body: user_id (optional, defaults to the caller or the device's user), longitude, latitude, battery, heart_rate (optional), skin_contact (optional; false when the heart-rate sensor lost contact), recorded_at (optional)
+// Optional fix quality: accuracy, speed, heading, altitude, satellites, source
 func postStatus(c echo.Context) error {
 	var req StatusRequest
 
@@ -367,70 +571,163 @@ func postStatus(c echo.Context) error {
 		})
 	}
 
-	// Validate required fields
-	if req.UserID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "user_id is required",
-		})
+	userID, deviceID, err := ingestUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
-	// Optional basic validation
-	if req.Longitude < -180 || req.Longitude > 180 ||
-		req.Latitude < -90 || req.Latitude > 90 {
+	if err := req.Validate(time.Now()); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "invalid latitude/longitude range",
+			"error": err.Error(),
 		})
 	}
 
-	if req.Battery < 0 || req.Battery > 100 {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "battery must be between 0 and 100",
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "failed to create status record",
 		})
 	}
+	defer tx.Rollback(ctx)
 
-	query := `
-		INSERT INTO stats (user_id, longitude, latitude, battery, heart_rate)
-		VALUES ($1, $2, $3, $4, $5)
-	`
-
-	_, err := DB.Exec(
-		context.Background(),
-		query,
-		req.UserID,
-		req.Longitude,
-		req.Latitude,
-		req.Battery,
-		req.HeartRate,
-	)
+	_, created, err := insertStatus(ctx, tx, userID, deviceID, req)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "failed to create status record",
 		})
 	}
 
+	if !created {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "status already recorded",
+		})
+	}
 	return c.JSON(http.StatusCreated, map[string]string{
 		"message": "status created successfully",
 	})
 }
 
+// POST /Status/batch - Upload several readings at once, typically the backlog
+// a cane buffered while offline
+// Body: user_id (optional), readings: [{longitude, latitude, battery, heart_rate, recorded_at, accuracy, ...}, ...]
+// Each reading is accepted or rejected on its own; results follow the order of readings.
+func postStatusBatch(c echo.Context) error {
+	var req BatchStatusRequest
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "invalid request body",
+		})
+	}
+
+	userID, deviceID, err := ingestUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+
+	if len(req.Readings) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "readings must contain at least one reading",
+		})
+	}
+	if len(req.Readings) > maxStatusBatch {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "readings may contain at most 500 readings",
+		})
+	}
+
+	now := time.Now()
+	resp := BatchStatusResponse{Results: make([]BatchStatusResult, len(req.Readings))}
+	valid := []int{}
+	readings := make([]StatusRequest, len(req.Readings))
+	for i, raw := range req.Readings {
+		resp.Results[i].Index = i
+		if err := json.Unmarshal(raw, &readings[i]); err != nil {
+			resp.Results[i].Status, resp.Results[i].Error = "invalid", "invalid reading"
+			continue
+		}
+		if err := readings[i].Validate(now); err != nil {
+			resp.Results[i].Status, resp.Results[i].Error = "invalid", err.Error()
+			continue
+		}
+		recordedAt := readings[i].recordedAt
+		resp.Results[i].RecordedAt = &recordedAt
+		valid = append(valid, i)
+	}
+
+	// Store oldest first, so anything that reacts to new readings sees them in
+	// the order they happened
+	sort.SliceStable(valid, func(a, b int) bool {
+		return readings[valid[a]].recordedAt.Before(readings[valid[b]].recordedAt)
+	})
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "failed to create status records",
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	for _, i := range valid {
+		id, created, err := insertStatus(ctx, tx, userID, deviceID, readings[i])
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to create status records",
+			})
+		}
+		if created {
+			resp.Results[i].Status, resp.Results[i].ID = "created", &id
+		} else {
+			resp.Results[i].Status = "duplicate"
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "failed to create status records",
+		})
+	}
+
+	for _, r := range resp.Results {
+		switch r.Status {
+		case "created":
+			resp.Created++
+		case "duplicate":
+			resp.Duplicates++
+		case "invalid":
+			resp.Invalid++
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
 type FullStatusResponse struct {
-	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
-	Longitude float64   `json:"longitude"`
-	Latitude  float64   `json:"latitude"`
-	Battery   int       `json:"battery"`
-	HeartRate *int      `json:"heart_rate"`
-	CreatedAt time.Time `json:"created_at"`
+	ID     int    `json:"id"`
+	UserID string `json:"user_id"`
+	Fix
+	Battery    int       `json:"battery"`
+	HeartRate  *int      `json:"heart_rate"`
+	DeviceID   *int      `json:"device_id"`
+	CreatedAt  time.Time `json:"created_at"`  // when the reading was taken
+	ReceivedAt time.Time `json:"received_at"` // when the server got it
+
+	Connectivity *Connectivity `json:"connectivity"`
 }
 
 func getStatus(c echo.Context) error {
-	userID := c.QueryParam("user_id")
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "user_id query parameter is required"})
+	userID, err := targetUserID(c, c.QueryParam("user_id"))
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `
-		SELECT id, user_id, longitude, latitude, battery, heart_rate, created_at
+		SELECT id, user_id, ` + locationColumns + `, battery, heart_rate, device_id, created_at, received_at
 		FROM stats
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -438,19 +735,32 @@ func getStatus(c echo.Context) error {
 	`
 
 	var status FullStatusResponse
-	err := DB.QueryRow(context.Background(), query, userID).Scan(
+	err = DB.QueryRow(context.Background(), query, userID).Scan(
 		&status.ID,
 		&status.UserID,
 		&status.Longitude,
 		&status.Latitude,
+		&status.Accuracy,
+		&status.Speed,
+		&status.Heading,
+		&status.Altitude,
+		&status.Satellites,
+		&status.Source,
 		&status.Battery,
 		&status.HeartRate,
+		&status.DeviceID,
 		&status.CreatedAt,
+		&status.ReceivedAt,
 	)
 
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch status"})
 	}
 
+	status.Connectivity, err = loadConnectivity(context.Background(), userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to fetch connectivity"})
+	}
+
 	return c.JSON(http.StatusOK, status)
 }
@@ -0,0 +1,264 @@
+package main
+
+// ─── File storage ────────────────────────────────────────────────────────────
+//
+// Env vars:
+//   STORAGE              — "local" or "s3"                          (default local)
+//   STORAGE_DIR          — directory the local backend writes to     (default uploads)
+//   STORAGE_PUBLIC_URL   — base URL files are served from; the local backend
+//                          is served by the API under /uploads/     (default /uploads)
+//   S3_ENDPOINT          — e.g. http://minio:9000 for a local stand-in
+//                                                  (default https://s3.<region>.amazonaws.com)
+//   S3_REGION            — (default us-east-1)
+//   S3_BUCKET, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY
+//   S3_PUBLIC_URL        — base URL objects are read from  (default <endpoint>/<bucket>)
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localStorageRoute is where the API serves files from the local backend.
+const localStorageRoute = "/uploads/"
+
+// Storage keeps public files such as avatars. Keys are slash-separated paths.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+var storage Storage = &LocalStorage{Dir: "uploads", BaseURL: "/uploads"}
+
+// newStorage builds the Storage selected by the STORAGE env var.
+func newStorage() Storage {
+	switch os.Getenv("STORAGE") {
+	case "s3":
+		region := envOr("S3_REGION", "us-east-1")
+		endpoint := strings.TrimRight(envOr("S3_ENDPOINT", "https://s3."+region+".amazonaws.com"), "/")
+		bucket := os.Getenv("S3_BUCKET")
+		return &S3Storage{
+			Endpoint:        endpoint,
+			Region:          region,
+			Bucket:          bucket,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicURL:       strings.TrimRight(envOr("S3_PUBLIC_URL", endpoint+"/"+bucket), "/"),
+			Client:          &http.Client{Timeout: 30 * time.Second},
+		}
+	default:
+		return &LocalStorage{
+			Dir:     envOr("STORAGE_DIR", "uploads"),
+			BaseURL: strings.TrimRight(envOr("STORAGE_PUBLIC_URL", strings.TrimSuffix(localStorageRoute, "/")), "/"),
+		}
+	}
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// ─── Local disk ──────────────────────────────────────────────────────────────
+
+type LocalStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, clean), nil
+}
+
+func (s *LocalStorage) Put(_ context.Context, key, _ string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStorage) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return s.BaseURL + "/" + key
+}
+
+// ─── S3-compatible ───────────────────────────────────────────────────────────
+
+// S3Storage talks to any S3-compatible service using path-style URLs and
+// AWS Signature Version 4, so it also works against MinIO and similar.
+type S3Storage struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PublicURL       string
+	Client          *http.Client
+}
+
+func (s *S3Storage) Put(ctx context.Context, key, contentType string, data []byte) error {
+	return s.do(ctx, http.MethodPut, key, data, map[string]string{
+		"content-type":  contentType,
+		"cache-control": "public, max-age=31536000, immutable",
+	})
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, http.MethodDelete, key, nil, nil)
+}
+
+func (s *S3Storage) URL(key string) string {
+	return s.PublicURL + "/" + s3EscapePath(key)
+}
+
+func (s *S3Storage) do(ctx context.Context, method, key string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, method,
+		s.Endpoint+"/"+s3EscapePath(s.Bucket)+"/"+s3EscapePath(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds SigV4 headers for the request. Every header already set on req is
+// signed along with host, x-amz-date and x-amz-content-sha256.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		signed[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// s3EscapePath URI-encodes each segment of a key the way SigV4 expects.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, ch := range []byte(segment) {
+			if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+				ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+				b.WriteByte(ch)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", ch)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
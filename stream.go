@@ -14,6 +14,8 @@ package main
 //   STREAM_UDP_ADDR  — where to listen for the Pi stream (default udp://0.0.0.0:8554)
 //   STREAM_FPS       — output frame rate                  (default 15)
 //   STREAM_QUALITY   — ffmpeg -q:v 1-31, lower=better    (default 5)
+//   STREAM_USER_ID   — cane user whose Pi feeds the stream; only they and
+//                      their caregivers may watch it       (no default)
 
 import (
 	"bytes"
@@ -154,6 +156,9 @@ var wsServer = websocket.Server{
 
 // streamWSHandler is the Echo handler for GET /ws/stream
 func streamWSHandler(c echo.Context) error {
+	if err := authorizeStream(c); err != nil {
+		return accessError(c, err)
+	}
 	wsServer.ServeHTTP(c.Response(), c.Request())
 	return nil
 }
@@ -206,6 +211,9 @@ func (c *streamClient) readPump() {
 
 // streamStatusHandler handles GET /stream/status
 func streamStatusHandler(c echo.Context) error {
+	if err := authorizeStream(c); err != nil {
+		return accessError(c, err)
+	}
 	return c.JSON(http.StatusOK, echo.Map{
 		"streaming": hub.streaming.Load(),
 		"clients":   hubClientCount(),
@@ -230,6 +238,21 @@ func streamFPS() string {
 	return "15"
 }
 
+func streamUserID() string {
+	return os.Getenv("STREAM_USER_ID")
+}
+
+// authorizeStream checks that the caller may watch the stream owner's feed.
+// Without a configured owner nobody may, since the feed cannot be attributed.
+func authorizeStream(c echo.Context) error {
+	owner := streamUserID()
+	if owner == "" {
+		return errForbidden
+	}
+	_, err := targetUserID(c, owner)
+	return err
+}
+
 func streamQuality() string {
 	if v := os.Getenv("STREAM_QUALITY"); v != "" {
 		return v
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Failed sign-ins are counted per email address and per client IP in the
+// LoginThrottles table, so limits hold across restarts and API instances.
+// After a few free attempts every failure doubles the wait before the next
+// try; at LOGIN_MAX_FAILURES an account is locked for LOGIN_LOCKOUT_MINUTES.
+// A lock ends on its own or when the password is reset.
+//
+// Client IPs come from the connection. X-Forwarded-For is only believed when
+// it was added by a proxy in TRUSTED_PROXIES (comma-separated CIDRs), so a
+// client can't dodge the per-IP limit by sending its own.
+
+const (
+	loginFreeAttempts  = 3
+	loginMaxBackoff    = 15 * time.Minute
+	loginFailureWindow = time.Hour // failures older than this are forgotten
+	ipFailureFactor    = 5         // an IP may fail this many times more than one account
+)
+
+type loginThrottle struct {
+	Failures    int
+	LockedUntil time.Time
+}
+
+func loginMaxFailures() int {
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && v > 0 {
+		return v
+	}
+	return 10
+}
+
+func loginLockoutDuration() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_MINUTES")); err == nil && v > 0 {
+		return time.Duration(v) * time.Minute
+	}
+	return 30 * time.Minute
+}
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientIPExtractor returns how c.RealIP() finds the client, for
+// echo.IPExtractor. Sessions and the admin audit trail record the same IP.
+func clientIPExtractor() echo.IPExtractor {
+	var trusted []echo.TrustOption
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("[auth] ignoring TRUSTED_PROXIES entry %q: %v", cidr, err)
+			continue
+		}
+		trusted = append(trusted, echo.TrustIPRange(ipNet))
+	}
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	return echo.ExtractIPFromXFFHeader(append([]echo.TrustOption{
+		echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false),
+	}, trusted...)...)
+}
+
+func ipThrottleKey(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// loginBackoff returns how long to block further attempts after failures.
+func loginBackoff(failures, maxFailures int) time.Duration {
+	if failures >= maxFailures {
+		return loginLockoutDuration()
+	}
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-loginFreeAttempts))) * time.Second
+	return min(delay, loginMaxBackoff)
+}
+
+// getLoginThrottle returns the recent failures against key. A lock outlives
+// the failure window when LOGIN_LOCKOUT_MINUTES is longer than it.
+func getLoginThrottle(ctx context.Context, key string) (loginThrottle, error) {
+	var t loginThrottle
+	var lockedUntil *time.Time
+	err := DB.QueryRow(ctx,
+		`SELECT failures, locked_until FROM LoginThrottles WHERE key = $1 AND (last_failure_at > $2 OR locked_until > now())`,
+		key, time.Now().Add(-loginFailureWindow),
+	).Scan(&t.Failures, &lockedUntil)
+	if err == pgx.ErrNoRows {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+	if lockedUntil != nil {
+		t.LockedUntil = *lockedUntil
+	}
+	return t, nil
+}
+
+// recordLoginFailure counts a failure against key and extends its block.
+func recordLoginFailure(ctx context.Context, key string, maxFailures int) error {
+	var failures int
+	err := DB.QueryRow(ctx, `
+		INSERT INTO LoginThrottles (key, failures, last_failure_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN LoginThrottles.last_failure_at > $2 THEN LoginThrottles.failures + 1 ELSE 1 END,
+			last_failure_at = now()
+		RETURNING failures
+	`, key, time.Now().Add(-loginFailureWindow)).Scan(&failures)
+	if err != nil {
+		return err
+	}
+
+	backoff := loginBackoff(failures, maxFailures)
+	if backoff == 0 {
+		return nil
+	}
+	_, err = DB.Exec(ctx, `UPDATE LoginThrottles SET locked_until = $1 WHERE key = $2`, time.Now().Add(backoff), key)
+	return err
+}
+
+func clearLoginThrottle(ctx context.Context, key string) error {
+	_, err := DB.Exec(ctx, `DELETE FROM LoginThrottles WHERE key = $1`, key)
+	return err
+}
+
+// loginBlock returns the status and body to reject a sign-in attempt with,
+// or a zero status when the account and client may try.
+func loginBlock(c echo.Context, email string) (int, echo.Map, error) {
+	ctx := c.Request().Context()
+	now := time.Now()
+
+	account, err := getLoginThrottle(ctx, emailThrottleKey(email))
+	if err != nil {
+		return 0, nil, err
+	}
+	if account.LockedUntil.After(now) {
+		retry := retryAfter(c, account.LockedUntil.Sub(now))
+		if account.Failures >= loginMaxFailures() {
+			return http.StatusLocked, echo.Map{
+				"error":        "Account temporarily locked after too many failed sign-in attempts. Wait or reset your password to unlock it.",
+				"locked_until": account.LockedUntil,
+				"retry_after":  retry,
+			}, nil
+		}
+		return http.StatusTooManyRequests, echo.Map{
+			"error":       "Too many failed sign-in attempts, try again later",
+			"retry_after": retry,
+		}, nil
+	}
+
+	client, err := getLoginThrottle(ctx, ipThrottleKey(c))
+	if err != nil {
+		return 0, nil, err
+	}
+	if client.LockedUntil.After(now) {
+		return http.StatusTooManyRequests, echo.Map{
+			"error":       "Too many failed sign-in attempts from this address, try again later",
+			"retry_after": retryAfter(c, client.LockedUntil.Sub(now)),
+		}, nil
+	}
+
+	return 0, nil, nil
+}
+
+// retryAfter sets the Retry-After header and returns the wait in seconds.
+func retryAfter(c echo.Context, wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// loginFailed records a failed attempt for the account and the client.
+func loginFailed(c echo.Context, email string) error {
+	ctx := c.Request().Context()
+	if err := recordLoginFailure(ctx, emailThrottleKey(email), loginMaxFailures()); err != nil {
+		return err
+	}
+	return recordLoginFailure(ctx, ipThrottleKey(c), loginMaxFailures()*ipFailureFactor)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// tokenHashKey returns the HMAC key used to hash bearer tokens before they are
+// stored. It comes from SESSION_SECRET, which main requires: every stored
+// session, device key, recovery code, reset and verification token is hashed
+// with it, so changing it invalidates all of them at once.
+func tokenHashKey() []byte {
+	return []byte(os.Getenv("SESSION_SECRET"))
+}
+
+// hashToken returns the keyed hash stored in place of a random token. Tokens
+// carry enough entropy that a single HMAC is enough, and the result can be
+// looked up directly through a unique index.
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, tokenHashKey())
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP (RFC 6238) with the parameters every authenticator app supports:
+// SHA-1, 6 digits, 30 second steps. Codes from one step either side of the
+// current one are accepted to allow for clock drift, and each step can only be
+// used once.
+
+const (
+	totpIssuer        = "PathPal"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+
+	loginChallengeDuration    = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+// twoFactorSetupRoutes stay reachable for accounts whose role requires 2FA
+// but which have not enrolled yet.
+var twoFactorSetupRoutes = map[string]bool{
+	"GET /session":      true,
+	"DELETE /session":   true,
+	"GET /user":         true,
+	"POST /2fa/setup":   true,
+	"POST /2fa/confirm": true,
+}
+
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+}
+
+type LoginTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactorRequired reports whether accounts of role must use 2FA, according
+// to the comma-separated REQUIRE_2FA_ROLES env var. Admins always must.
+func twoFactorRequired(role string) bool {
+	if role == adminRole {
+		return true
+	}
+	for _, r := range strings.Split(os.Getenv("REQUIRE_2FA_ROLES"), ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the time step code is valid for, if any.
+func matchTOTP(secretB32, code string, now time.Time) (int64, bool) {
+	secret, err := base32NoPad.DecodeString(strings.ToUpper(secretB32))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func otpauthURI(email, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// useTOTPCode checks code against the user's secret and records the step so
+// the same code cannot be replayed. enabled selects the confirmed secret or
+// the one pending enrollment.
+func useTOTPCode(ctx context.Context, userID, code string, enabled bool) (bool, error) {
+	var secret *string
+	sql := `SELECT totp_secret FROM Users WHERE user_id = $1 AND (totp_enabled_at IS NOT NULL) = $2`
+	err := DB.QueryRow(ctx, sql, userID, enabled).Scan(&secret)
+	if err == pgx.ErrNoRows || (err == nil && secret == nil) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTP(*secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	cmdTag, err := DB.Exec(ctx, `
+		UPDATE Users SET totp_last_step = $1
+		WHERE user_id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)
+	`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	return cmdTag.RowsAffected() == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes.
+func useRecoveryCode(ctx context.Context, userID, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	cmdTag, err := DB.Exec(ctx, `
+		UPDATE RecoveryCodes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	return cmdTag.RowsAffected() == 1, nil
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and returns a new set.
+func replaceRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM RecoveryCodes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		if _, err := tx.Exec(ctx, `INSERT INTO RecoveryCodes (user_id, code_hash) VALUES ($1, $2)`, userID, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+// startLoginChallenge records that userID passed the password step and returns
+// the token the client exchanges, together with a code, for a session.
+func startLoginChallenge(ctx context.Context, userID, sessionName string) (string, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = DB.Exec(ctx,
+		`INSERT INTO LoginChallenges (user_id, token_hash, session_name, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, hashToken(token), sessionName, time.Now().Add(loginChallengeDuration),
+	)
+	return token, err
+}
+
+// POST /2fa/setup - Generate a TOTP secret for the caller to add to an authenticator app
+func setupTwoFactor(c echo.Context) error {
+	user := currentUser(c)
+	if user.TwoFactor {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is already enabled"})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate secret"})
+	}
+
+	ctx := c.Request().Context()
+	_, err = DB.Exec(ctx, `UPDATE Users SET totp_secret = $1, totp_last_step = NULL WHERE user_id = $2 AND totp_enabled_at IS NULL`, secret, user.UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to save secret"})
+	}
+
+	return c.JSON(http.StatusOK, TwoFactorSetupResponse{
+		Secret:     secret,
+		OtpauthURI: otpauthURI(user.Email, secret),
+	})
+}
+
+// POST /2fa/confirm - Enable 2FA with a code from the new secret; returns recovery codes
+func confirmTwoFactor(c echo.Context) error {
+	var req TwoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+
+	user := currentUser(c)
+	if user.TwoFactor {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is already enabled"})
+	}
+
+	ctx := c.Request().Context()
+	ok, err := useTOTPCode(ctx, user.UserID, req.Code, false)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid code"})
+	}
+
+	if _, err := DB.Exec(ctx, `UPDATE Users SET totp_enabled_at = now() WHERE user_id = $1`, user.UserID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to enable two-factor authentication"})
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, user.UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate recovery codes"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+// POST /2fa/recovery-codes - Replace the caller's recovery codes
+func regenerateRecoveryCodes(c echo.Context) error {
+	var req TwoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+
+	ctx := c.Request().Context()
+	user := currentUser(c)
+	ok, err := useTOTPCode(ctx, user.UserID, req.Code, true)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !ok {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid code"})
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, user.UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate recovery codes"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+// DELETE /2fa - Turn 2FA off after re-entering the password
+func disableTwoFactor(c echo.Context) error {
+	var req DisableTwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+
+	ctx := c.Request().Context()
+	user := currentUser(c)
+	if twoFactorRequired(user.Type) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Two-factor authentication is required for this account"})
+	}
+
+	var passwordHash string
+	if err := DB.QueryRow(ctx, `SELECT password_hash FROM Users WHERE user_id = $1`, user.UserID).Scan(&passwordHash); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid credentials"})
+	}
+
+	_, err := DB.Exec(ctx, `
+		UPDATE Users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+		WHERE user_id = $1
+	`, user.UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to disable two-factor authentication"})
+	}
+	if _, err := DB.Exec(ctx, `DELETE FROM RecoveryCodes WHERE user_id = $1`, user.UserID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete recovery codes"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Two-factor authentication disabled"})
+}
+
+// POST /login/2fa - Second login step: exchange the challenge from POST /login
+// and a TOTP or recovery code for a session cookie
+func loginTwoFactor(c echo.Context) error {
+	var req LoginTwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "challenge_token and code or recovery_code are required"})
+	}
+
+	ctx := c.Request().Context()
+	var challengeID int
+	var userID, sessionName string
+	// Claim an attempt before checking the code, so concurrent requests can't
+	// share the last one
+	err := DB.QueryRow(ctx, `
+		UPDATE LoginChallenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expires_at > now() AND attempts < $2
+		RETURNING id, user_id, session_name
+	`, hashToken(req.ChallengeToken), loginChallengeMaxAttempts).Scan(&challengeID, &userID, &sessionName)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Login challenge is invalid or expired"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	status, body, err := loginBlock(c, user.Email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if status != 0 {
+		return c.JSON(status, body)
+	}
+
+	var ok bool
+	if req.RecoveryCode != "" {
+		ok, err = useRecoveryCode(ctx, userID, req.RecoveryCode)
+	} else {
+		ok, err = useTOTPCode(ctx, userID, req.Code, true)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !ok {
+		if err := loginFailed(c, user.Email); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid code"})
+	}
+
+	if _, err := DB.Exec(ctx, `DELETE FROM LoginChallenges WHERE id = $1`, challengeID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if err := clearLoginThrottle(ctx, emailThrottleKey(user.Email)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	if err := startSession(c, user.UserID, sessionName); err == errAccountDisabled {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Account disabled"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create session"})
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
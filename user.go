@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"strings"
 	"time"
 
@@ -13,41 +15,57 @@ import (
 )
 
 type UserGET struct {
-	UserID    string    `json:"user_id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Type      string    `json:"type"`
-	BirthDate time.Time `json:"birth_date"`
-	HomeLong  float64   `json:"home_long"`
-	HomeLat   float64   `json:"home_lat"`
-	AvatarUrl string    `json:"avatar_url"`
-	CreatedAt time.Time `json:"created_at"`
+	UserID        string    `json:"user_id"`
+	Email         string    `json:"email"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	BirthDate     time.Time `json:"birth_date"`
+	HomeLong      float64   `json:"home_long"`
+	HomeLat       float64   `json:"home_lat"`
+	AvatarUrl     string    `json:"avatar_url"`
+	EmailVerified bool      `json:"email_verified"`
+	TwoFactor     bool      `json:"two_factor_enabled"`
+	CreatedAt     time.Time `json:"created_at"`
 }
+
+// UserPUT is a partial update: only fields present in the body change.
+// Changing the email or password also needs the current password.
 type UserPUT struct {
-	UserID    string    `json:"user_id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Type      string    `json:"type"`
-	BirthDate time.Time `json:"birth_date"`
-	HomeLong  float64   `json:"home_long"`
-	HomeLat   float64   `json:"home_lat"`
-	AvatarUrl string    `json:"avatar_url"`
-	Password  string    `json:"password"`
+	UserID          string     `json:"user_id"`
+	Email           *string    `json:"email"`
+	Name            *string    `json:"name"`
+	Type            *string    `json:"type"`
+	BirthDate       *time.Time `json:"birth_date"`
+	HomeLong        *float64   `json:"home_long"`
+	HomeLat         *float64   `json:"home_lat"`
+	AvatarUrl       *string    `json:"avatar_url"`
+	Password        *string    `json:"password"`
+	CurrentPassword string     `json:"current_password"`
 }
 
 func getUser(c echo.Context) error {
-	userID := c.QueryParam("user_id")
-	if userID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "user_id query parameter is required"})
+	requested := c.QueryParam("user_id")
+	userID, err := targetUserID(c, requested)
+	if err == errForbidden && currentUser(c).Type == "Cane_User" && isUUID(requested) {
+		// Cane users may also view the profiles of their own caregivers
+		var linked bool
+		linked, err = isGuardianOf(c.Request().Context(), requested, currentUser(c).UserID)
+		if err == nil && !linked {
+			err = errForbidden
+		}
+		userID = requested
+	}
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `
-		SELECT user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, created_at
+		SELECT user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at
 		FROM users
 		WHERE user_id = $1`
 
 	var user UserGET
-	err := DB.QueryRow(context.Background(), query, userID).
+	err = DB.QueryRow(context.Background(), query, userID).
 		Scan(
 			&user.UserID,
 			&user.Email,
@@ -57,6 +75,8 @@ func getUser(c echo.Context) error {
 			&user.HomeLong,
 			&user.HomeLat,
 			&user.AvatarUrl,
+			&user.EmailVerified,
+			&user.TwoFactor,
 			&user.CreatedAt,
 		)
 
@@ -83,20 +103,20 @@ func deleteUser(c echo.Context) error {
 		})
 	}
 
-	if strings.TrimSpace(req.UserID) == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "user_id is required",
-		})
+	userID, err := selfUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
 	}
 
 	query := `
 		DELETE FROM users
 		WHERE user_id = $1
-		RETURNING user_id
+		RETURNING user_id, avatar_key
 	`
 
 	var deletedUserID string
-	err := DB.QueryRow(context.Background(), query, req.UserID).Scan(&deletedUserID)
+	var avatarKey *string
+	err = DB.QueryRow(context.Background(), query, userID).Scan(&deletedUserID, &avatarKey)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return c.JSON(http.StatusNotFound, echo.Map{
@@ -108,6 +128,12 @@ func deleteUser(c echo.Context) error {
 		})
 	}
 
+	if avatarKey != nil {
+		deleteAvatarFiles(context.Background(), *avatarKey)
+	}
+
+	clearSessionCookie(c)
+
 	return c.JSON(http.StatusOK, echo.Map{
 		"message": "User deleted",
 		"user_id": deletedUserID,
@@ -115,6 +141,7 @@ func deleteUser(c echo.Context) error {
 
 }
 
+// PUT/PATCH /user - Update the caller's own profile
 func putUser(c echo.Context) error {
 	var req UserPUT
 	if err := c.Bind(&req); err != nil {
@@ -123,65 +150,199 @@ func putUser(c echo.Context) error {
 		})
 	}
 
-	if strings.TrimSpace(req.UserID) == "" {
+	userID, err := selfUserID(c, req.UserID)
+	if err != nil {
+		return accessError(c, err)
+	}
+	req.UserID = userID
+
+	if err := req.Validate(); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "user_id is required",
+			"error": err.Error(),
 		})
 	}
 
-	var user UserGET
-	var err error
+	ctx := c.Request().Context()
+
+	var current UserGET
+	var passwordHash string
+	err = DB.QueryRow(ctx, `
+		SELECT email, password_hash, name, type, birth_date, home_long, home_lat, avatar_url
+		FROM users
+		WHERE user_id = $1
+	`, userID).Scan(
+		&current.Email, &passwordHash, &current.Name, &current.Type, &current.BirthDate,
+		&current.HomeLong, &current.HomeLat, &current.AvatarUrl,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.JSON(http.StatusNotFound, echo.Map{
+				"error": "User not found",
+			})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+
+	emailChanged := req.Email != nil && *req.Email != current.Email
+	if emailChanged || req.Password != nil {
+		if req.CurrentPassword == "" {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "current_password is required to change email or password",
+			})
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)) != nil {
+			return c.JSON(http.StatusForbidden, echo.Map{
+				"error": "Current password is incorrect",
+			})
+		}
+	}
+
+	if req.Type != nil && *req.Type != current.Type {
+		// Guardian links and devices only make sense for the role they were made under
+		var linked bool
+		err = DB.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM Guardians WHERE caregiver_user_id = $1 OR cane_user_id = $1)
+			    OR EXISTS (SELECT 1 FROM Devices WHERE user_id = $1 AND revoked_at IS NULL)
+		`, userID).Scan(&linked)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to check account links",
+			})
+		}
+		if linked {
+			return c.JSON(http.StatusConflict, echo.Map{
+				"error": "Remove guardian links and devices before changing account type",
+			})
+		}
+		current.Type = *req.Type
+	}
 
-	if req.Password != "" {
-		// Update including new password hash
-		hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(req.Password), 12)
+	if req.Email != nil {
+		current.Email = *req.Email
+	}
+	if req.Name != nil {
+		current.Name = *req.Name
+	}
+	if req.BirthDate != nil {
+		current.BirthDate = *req.BirthDate
+	}
+	if req.HomeLong != nil {
+		current.HomeLong = *req.HomeLong
+	}
+	if req.HomeLat != nil {
+		current.HomeLat = *req.HomeLat
+	}
+	if req.AvatarUrl != nil {
+		current.AvatarUrl = *req.AvatarUrl
+	}
+	if req.Password != nil {
+		hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(*req.Password), 12)
 		if hashErr != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{
 				"error": "Password hashing failed",
 			})
 		}
-		query := `
-			UPDATE users
-			SET email=$1, password_hash=$2, name=$3, type=$4, birth_date=$5,
-			    home_long=$6, home_lat=$7, avatar_url=$8
-			WHERE user_id=$9
-			RETURNING user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, created_at
-		`
-		err = DB.QueryRow(context.Background(), query,
-			req.Email, string(hashedPassword), req.Name, req.Type, req.BirthDate,
-			req.HomeLong, req.HomeLat, req.AvatarUrl, req.UserID,
-		).Scan(
-			&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate,
-			&user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.CreatedAt,
-		)
-	} else {
-		// Update without touching password_hash
-		query := `
-			UPDATE users
-			SET email=$1, name=$2, type=$3, birth_date=$4,
-			    home_long=$5, home_lat=$6, avatar_url=$7
-			WHERE user_id=$8
-			RETURNING user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, created_at
-		`
-		err = DB.QueryRow(context.Background(), query,
-			req.Email, req.Name, req.Type, req.BirthDate,
-			req.HomeLong, req.HomeLat, req.AvatarUrl, req.UserID,
-		).Scan(
-			&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate,
-			&user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.CreatedAt,
-		)
+		passwordHash = string(hashedPassword)
 	}
 
+	query := `
+		UPDATE users
+		SET email=$1, password_hash=$2, name=$3, type=$4, birth_date=$5,
+		    home_long=$6, home_lat=$7, avatar_url=$8,
+		    email_verified_at = CASE WHEN email = $1 THEN email_verified_at END
+		WHERE user_id=$9
+		RETURNING user_id, email, name, type, birth_date, home_long, home_lat, avatar_url, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at
+	`
+	var user UserGET
+	err = DB.QueryRow(ctx, query,
+		current.Email, passwordHash, current.Name, current.Type, current.BirthDate,
+		current.HomeLong, current.HomeLat, current.AvatarUrl, userID,
+	).Scan(
+		&user.UserID, &user.Email, &user.Name, &user.Type, &user.BirthDate,
+		&user.HomeLong, &user.HomeLat, &user.AvatarUrl, &user.EmailVerified, &user.TwoFactor, &user.CreatedAt,
+	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return c.JSON(http.StatusNotFound, echo.Map{
 				"error": "User not found",
 			})
 		}
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			return c.JSON(http.StatusConflict, echo.Map{
+				"error": "Email already exists",
+			})
+		}
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to update user",
 		})
 	}
 
+	if req.HomeLong != nil || req.HomeLat != nil {
+		if err := syncHomePlace(ctx, user.UserID, user.HomeLong, user.HomeLat); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to update home place",
+			})
+		}
+	}
+
+	// A changed address has to be confirmed again
+	if emailChanged {
+		if err := sendVerificationEmail(ctx, user.UserID, user.Name, user.Email); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to send verification email",
+			})
+		}
+	}
+
+	// A new password signs out every other session
+	if req.Password != nil {
+		if err := deleteOtherSessions(ctx, user.UserID, currentSessionID(c)); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to revoke other sessions",
+			})
+		}
+	}
+
 	return c.JSON(http.StatusOK, user)
 }
+
+func (r *UserPUT) Validate() error {
+	if r.Email == nil && r.Name == nil && r.Type == nil && r.BirthDate == nil &&
+		r.HomeLong == nil && r.HomeLat == nil && r.AvatarUrl == nil && r.Password == nil {
+		return errors.New("at least one field must be provided")
+	}
+
+	if r.Email != nil {
+		email := strings.TrimSpace(*r.Email)
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			return errors.New("email is not a valid address")
+		}
+		*r.Email = email
+	}
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if name == "" {
+			return errors.New("name cannot be empty")
+		}
+		*r.Name = name
+	}
+	if r.Type != nil && *r.Type != "Cane_User" && *r.Type != "Caregiver" {
+		return errors.New("Invalid user type")
+	}
+	if r.BirthDate != nil && r.BirthDate.After(time.Now()) {
+		return errors.New("birth_date cannot be in the future")
+	}
+	if r.HomeLong != nil && !isValidLongitude(*r.HomeLong) {
+		return errors.New("home_long must be between -180 and 180")
+	}
+	if r.HomeLat != nil && !isValidLatitude(*r.HomeLat) {
+		return errors.New("home_lat must be between -90 and 90")
+	}
+	if r.Password != nil && *r.Password == "" {
+		return errors.New("password cannot be empty")
+	}
+	return nil
+}
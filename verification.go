@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const emailVerificationDuration = 48 * time.Hour
+
+// What an account with an unconfirmed email address may do, set with
+// EMAIL_VERIFICATION_POLICY:
+//
+//	off        — everything
+//	restricted — sign in and manage their own account (default)
+//	required   — nothing; sign-in is refused until the address is confirmed
+const (
+	verificationPolicyOff        = "off"
+	verificationPolicyRestricted = "restricted"
+	verificationPolicyRequired   = "required"
+)
+
+// unverifiedRoutes are reachable by unverified accounts under the restricted policy.
+var unverifiedRoutes = map[string]bool{
+	"GET /session":            true,
+	"DELETE /session":         true,
+	"GET /sessions":           true,
+	"PUT /sessions":           true,
+	"DELETE /sessions":        true,
+	"DELETE /sessions/others": true,
+	"GET /user":               true,
+	"PUT /user":               true,
+	"PATCH /user":             true,
+	"DELETE /user":            true,
+	"POST /user/avatar":       true,
+	"DELETE /user/avatar":     true,
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+func emailVerificationPolicy() string {
+	switch v := os.Getenv("EMAIL_VERIFICATION_POLICY"); v {
+	case verificationPolicyOff, verificationPolicyRequired:
+		return v
+	default:
+		return verificationPolicyRestricted
+	}
+}
+
+// unverifiedAllowed reports whether an unverified account may use route.
+func unverifiedAllowed(route string) bool {
+	switch emailVerificationPolicy() {
+	case verificationPolicyOff:
+		return true
+	case verificationPolicyRestricted:
+		return unverifiedRoutes[route]
+	default:
+		return false
+	}
+}
+
+// sendVerificationEmail issues a new verification token for email, replacing
+// any earlier one, and mails the link to that address.
+func sendVerificationEmail(ctx context.Context, userID, name, email string) error {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	if _, err := DB.Exec(ctx, `DELETE FROM EmailVerifications WHERE user_id = $1 AND used_at IS NULL`, userID); err != nil {
+		return err
+	}
+	_, err = DB.Exec(ctx,
+		`INSERT INTO EmailVerifications (user_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, email, hashToken(token), time.Now().Add(emailVerificationDuration),
+	)
+	if err != nil {
+		return err
+	}
+
+	sendMail(Message{
+		To:      email,
+		Subject: "Confirm your PathPal email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm this email address for your PathPal account by opening the link below:\n\n%s\n\n"+
+			"The link expires in 48 hours. If you did not sign up for PathPal, you can ignore this email.\n",
+			name, appURL()+"/verify-email?token="+url.QueryEscape(token)),
+	})
+	return nil
+}
+
+// POST /email/verify - Confirm an email address with the emailed token
+func verifyEmail(c echo.Context) error {
+	var req VerifyEmailRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.Token == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "token is required"})
+	}
+
+	ctx := c.Request().Context()
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, email string
+	err = tx.QueryRow(ctx, `
+		UPDATE EmailVerifications SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, email
+	`, hashToken(req.Token)).Scan(&userID, &email)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Verification token is invalid or expired"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	// The token only confirms the address it was sent to
+	cmdTag, err := tx.Exec(ctx, `UPDATE Users SET email_verified_at = now() WHERE user_id = $1 AND email = $2`, userID, email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to verify email"})
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Email address has changed since this link was sent"})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Email verified"})
+}
+
+// POST /email/verify/resend - Send a fresh verification link. It is public so
+// accounts that cannot sign in under the required policy can still use it, and
+// responds the same whether or not the address is registered.
+func resendVerificationEmail(c echo.Context) error {
+	var req ResendVerificationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "email is required"})
+	}
+
+	sent := echo.Map{"message": "If that email is registered and unverified, a new link has been sent"}
+
+	ctx := c.Request().Context()
+	var userID, name string
+	err := DB.QueryRow(ctx,
+		`SELECT user_id, name FROM Users WHERE email = $1 AND email_verified_at IS NULL`, email,
+	).Scan(&userID, &name)
+	if err == pgx.ErrNoRows {
+		return c.JSON(http.StatusOK, sent)
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	if err := sendVerificationEmail(ctx, userID, name, email); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to send verification email"})
+	}
+
+	return c.JSON(http.StatusOK, sent)
+}